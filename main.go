@@ -14,38 +14,129 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"go/build/constraint"
+	"go/token"
+	"io"
+	"maps"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/samber/lo"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"golang.org/x/sys/cpu"
 	"modernc.org/cc/v4"
 )
 
 var supportedTypes = map[string]int{
-	"int64_t": 8,
-	"long":    8,
-	"float":   4,
-	"double":  8,
-	"_Bool":   1,
+	"int64_t":            8,
+	"long":               8,
+	"long long":          8,
+	"unsigned long long": 8,
+	"size_t":             8,
+	"ssize_t":            8,
+	"ptrdiff_t":          8,
+	"intptr_t":           8,
+	"uintptr_t":          8,
+	"int":                4,
+	"int32_t":            4,
+	"uint32_t":           4,
+	"char":               1,
+	"signed char":        1,
+	"unsigned char":      1,
+	"float":              4,
+	"double":             8,
+	"_Bool":              1,
+	"float _Complex":     8,
+	"double _Complex":    16,
+	// pointer results, whatever they point to
+	"void *": 8,
+}
+
+// vectorTypes are the SIMD types of each architecture, which the C code can use through
+// pointer parameters, since Go has no vector types to pass them by value.
+var vectorTypes = map[string][]string{
+	"amd64": {"__m128", "__m128d", "__m128i", "__m256", "__m256d", "__m256i", "__m512", "__m512d", "__m512i"},
+	"arm64": {"int8x16_t", "uint8x16_t", "int16x8_t", "uint16x8_t", "int32x4_t", "uint32x4_t", "int64x2_t", "uint64x2_t",
+		"float32x4_t", "float64x2_t", "svint8_t", "svuint8_t", "svint16_t", "svuint16_t", "svint32_t", "svuint32_t",
+		"svint64_t", "svuint64_t", "svfloat32_t", "svfloat64_t", "svbool_t"},
+	"loong64": {"__m128", "__m128d", "__m128i", "__m256", "__m256d", "__m256i"},
+	"riscv64": {"vint8m1_t", "vuint8m1_t", "vint16m1_t", "vuint16m1_t", "vint32m1_t", "vuint32m1_t", "vint64m1_t", "vuint64m1_t",
+		"vfloat32m1_t", "vfloat64m1_t"},
+}
+
+// complexTypes maps complex types to the type of their real and imaginary parts.
+var complexTypes = map[string]string{
+	"float _Complex":  "float",
+	"double _Complex": "double",
 }
 
 type TranslateUnit struct {
-	Source     string
-	Assembly   string
-	Object     string
-	GoAssembly string
-	Go         string
-	Package    string
-	Options    []string
-	Offset     int
+	Source       string
+	Assembly     string
+	Object       string
+	GoAssembly   string
+	Go           string
+	Package      string
+	Options      []string
+	IncludePaths []string
+	// Benchmark is the path of the generated benchmarks, which are skipped if empty.
+	Benchmark string
+	// SymbolPrefix is prepended to the Go names of the functions, so that sources
+	// defining functions of the same name can be translated into one package.
+	SymbolPrefix string
+	// ParseOnly stops the translation after the Go stubs, without running clang or objdump,
+	// and lists the parsed functions to Out.
+	ParseOnly bool
+	// Out receives the output of the translation that is not an error, e.g. the functions
+	// listed by ParseOnly.
+	Out io.Writer
+	// Manifest is the path of the generated manifest, which is skipped if empty.
+	Manifest string
+	// BuildTags is combined with the build constraint of the target architecture if set.
+	BuildTags constraint.Expr
+	// StubArchs, if set, are the architectures that share the Go stub, which is then
+	// built for any of them.
+	StubArchs []string
+	// Compiler is either clang or gcc. gcc only compiles for the host.
+	Compiler string
+	// Append keeps the functions of existing generated files that are not in the source.
+	Append bool
+	// Slices adds wrappers taking slices instead of pointers to the Go stubs.
+	Slices bool
+	// Std is the C standard of the parser and the compiler, e.g. c11, or the default of the host compiler if empty.
+	Std string
+	// EmbedSource adds the SHA-256 of the source to the headers and the source itself to the Go stubs.
+	EmbedSource bool
+	// AutoNosplit marks the leaf functions with small stacks NOSPLIT, which skips the stack-growth prologue.
+	AutoNosplit bool
+	// Defines are macros defined for both the parser and the compiler, as NAME or NAME=VALUE.
+	Defines []string
+	// VerboseAsm adds the C signature and the registers of the parameters before each TEXT directive.
+	VerboseAsm bool
+	// AsmPostProcess, if set, rewrites the generated assembly after it is formatted.
+	AsmPostProcess func(string) (string, error)
+	// VerifySelfContained rejects generated assembly that depends on anything outside of it.
+	VerifySelfContained bool
+	// Strict rejects the instructions that cannot be translated, such as calls and PC-relative references.
+	Strict bool
+
+	// sourceCode is the content of the source, read by parseSource.
+	sourceCode []byte
 }
 
 func NewTranslateUnit(source string, outputDir string, options ...string) TranslateUnit {
@@ -60,20 +151,42 @@ func NewTranslateUnit(source string, outputDir string, options ...string) Transl
 		Go:         filepath.Join(outputDir, noExtSourceBase+".go"),
 		Package:    filepath.Base(outputDir),
 		Options:    options,
+		Compiler:   "clang",
+		Out:        os.Stdout,
 	}
 }
 
 // parseSource parse C source file and extract functions declarations.
 func (t *TranslateUnit) parseSource() ([]Function, error) {
-	f, err := os.Open(t.Source)
+	source, err := os.ReadFile(t.Source)
 	if err != nil {
 		return nil, err
 	}
-	cfg, err := cc.NewConfig(runtime.GOOS, runtime.GOARCH)
+	t.sourceCode = source
+	if slices.Contains(cppExtensions, filepath.Ext(t.Source)) {
+		source = extractExternC(source)
+	}
+	var cfgOptions []string
+	if t.Std != "" {
+		// the predefined macros, such as __STDC_VERSION__, depend on the standard
+		cfgOptions = append(cfgOptions, "-std="+t.Std)
+	}
+	cfg, err := cc.NewConfig(runtime.GOOS, runtime.GOARCH, cfgOptions...)
 	if err != nil {
 		return nil, err
 	}
+	// Like -I of clang, include paths are searched before the system ones.
+	cfg.IncludePaths = slices.Concat(cfg.IncludePaths[:1], t.IncludePaths, cfg.IncludePaths[1:])
+	cfg.SysIncludePaths = slices.Concat(t.IncludePaths, cfg.SysIncludePaths)
 	var prologue strings.Builder
+	for _, define := range t.Defines {
+		// like -D of clang, a macro without a value is defined as 1
+		name, value, ok := strings.Cut(define, "=")
+		if !ok {
+			value = "1"
+		}
+		prologue.WriteString(fmt.Sprintf("#define %s %s\n", name, value))
+	}
 	if cpu.RISCV64.HasV {
 		prologue.WriteString("#define __riscv_vector 1\n")
 		for _, typeStr := range []string{"int64", "uint64", "int32", "uint32", "int16", "uint16", "int8", "uint8", "float64", "float32", "float16"} {
@@ -82,12 +195,13 @@ func (t *TranslateUnit) parseSource() ([]Function, error) {
 			}
 		}
 	}
-	ast, err := cc.Parse(cfg, []cc.Source{
+	sources := []cc.Source{
 		{Name: "<predefined>", Value: cfg.Predefined},
 		{Name: "<builtin>", Value: cc.Builtin},
 		{Name: "<prologue>", Value: prologue.String()},
-		{Name: t.Source, Value: f},
-	})
+		{Name: t.Source, Value: source},
+	}
+	ast, err := cc.Parse(cfg, sources)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse source file %v: %w", t.Source, err)
 	}
@@ -95,8 +209,7 @@ func (t *TranslateUnit) parseSource() ([]Function, error) {
 	for tu := ast.TranslationUnit; tu != nil; tu = tu.TranslationUnit {
 		externalDeclaration := tu.ExternalDeclaration
 		if externalDeclaration.Position().Filename == t.Source && externalDeclaration.Case == cc.ExternalDeclarationFuncDef {
-			functionSpecifier := externalDeclaration.FunctionDefinition.DeclarationSpecifiers.FunctionSpecifier
-			if functionSpecifier != nil && functionSpecifier.Case == cc.FunctionSpecifierInline {
+			if isInline(externalDeclaration.FunctionDefinition) && !isExported(externalDeclaration.FunctionDefinition) {
 				// ignore inline functions
 				continue
 			}
@@ -110,52 +223,432 @@ func (t *TranslateUnit) parseSource() ([]Function, error) {
 	sort.Slice(functions, func(i, j int) bool {
 		return functions[i].Position < functions[j].Position
 	})
+	if err = t.convertStructResults(cfg, sources, functions); err != nil {
+		return nil, err
+	}
+	if err = t.applyLengthPragmas(source, functions); err != nil {
+		return nil, err
+	}
 	return functions, nil
 }
 
+// lengthPragma matches a comment fixing the number of elements that pointer parameters
+// point to, e.g. // goat:length data=512 weights=16.
+var lengthPragma = regexp.MustCompile(`^//\s*goat:length((?:\s+\w+=\d+)+)\s*$`)
+
+// applyLengthPragmas sets the lengths of parameters from the length pragmas in the
+// comment lines right above each function.
+func (t *TranslateUnit) applyLengthPragmas(source []byte, functions []Function) error {
+	lines := strings.Split(string(source), "\n")
+	for i, function := range functions {
+		for j := function.Position - 2; j >= 0 && j < len(lines); j-- {
+			line := strings.TrimSpace(lines[j])
+			if !strings.HasPrefix(line, "//") {
+				break
+			}
+			match := lengthPragma.FindStringSubmatch(line)
+			if match == nil {
+				continue
+			}
+			for _, field := range strings.Fields(match[1]) {
+				name, value, _ := strings.Cut(field, "=")
+				k := slices.IndexFunc(function.Parameters, func(param Parameter) bool {
+					return param.Name == name
+				})
+				if k < 0 || !function.Parameters[k].Pointer {
+					return fmt.Errorf("%v:%v: %v: goat:length of %v, which is not a pointer parameter",
+						t.Source, j+1, function.Name, name)
+				}
+				length, err := strconv.Atoi(value)
+				if err != nil || length == 0 {
+					return fmt.Errorf("%v:%v: %v: invalid goat:length of %v: %v", t.Source, j+1, function.Name, name, value)
+				}
+				functions[i].Parameters[k].Length = length
+			}
+		}
+	}
+	return nil
+}
+
+var atomicKeyword = regexp.MustCompile(`\b_Atomic\b\s*`)
+
+// stripAtomic removes _Atomic from source, both as a qualifier and as the _Atomic(T)
+// specifier, of which the parentheses are removed as well.
+func stripAtomic(source []byte) []byte {
+	var result []byte
+	for {
+		loc := atomicKeyword.FindIndex(source)
+		if loc == nil {
+			return append(result, source...)
+		}
+		result = append(result, source[:loc[0]]...)
+		source = source[loc[1]:]
+		if len(source) == 0 || source[0] != '(' {
+			continue
+		}
+		for i, depth := 0, 0; i < len(source); i++ {
+			if source[i] == '(' {
+				depth++
+			} else if source[i] == ')' {
+				if depth--; depth == 0 {
+					result = append(result, source[1:i]...)
+					source = source[i+1:]
+					break
+				}
+			}
+		}
+	}
+}
+
+// convertStructResults rewrites functions returning structs larger than 16 bytes,
+// which C ABIs return through a hidden pointer, to take that pointer as their first
+// parameter. The scalar fields of smaller structs, which are returned in registers,
+// become named Go results. Struct sizes are only known after type checking, which is
+// skipped unless some function returns an unsupported type.
+func (t *TranslateUnit) convertStructResults(cfg *cc.Config, sources []cc.Source, functions []Function) error {
+	if !slices.ContainsFunc(functions, func(function Function) bool {
+		_, ok := supportedTypes[function.Type]
+		_, hinted := unsupportedTypeHints[function.Type]
+		return function.Type != "void" && !ok && !hinted
+	}) {
+		return nil
+	}
+	// cc rejects _Atomic parameters, so the atomic qualifiers, which do not change sizes, are dropped before type checking
+	sources = slices.Clone(sources)
+	last := &sources[len(sources)-1]
+	last.Value = stripAtomic(last.Value.([]byte))
+	ast, err := cc.Translate(cfg, sources)
+	if err != nil {
+		return fmt.Errorf("failed to type check source file %v: %w", t.Source, err)
+	}
+	results := make(map[string]cc.Type)
+	for tu := ast.TranslationUnit; tu != nil; tu = tu.TranslationUnit {
+		externalDeclaration := tu.ExternalDeclaration
+		if externalDeclaration.Case == cc.ExternalDeclarationFuncDef {
+			declarator := externalDeclaration.FunctionDefinition.Declarator
+			if functionType, ok := declarator.Type().(*cc.FunctionType); ok {
+				results[declarator.Name()] = functionType.Result()
+			}
+		}
+	}
+	for i, function := range functions {
+		result, ok := results[function.Name]
+		if !ok || (result.Kind() != cc.Struct && result.Kind() != cc.Union) {
+			continue
+		}
+		if result.Size() <= 16 {
+			if functions[i].Results, err = convertResultFields(function, result); err != nil {
+				return err
+			}
+			continue
+		}
+		functions[i].Parameters = slices.Insert(function.Parameters, 0, Parameter{
+			Name:          "result",
+			ParameterType: ParameterType{Type: function.Type, Pointer: true},
+		})
+		functions[i].Type = "void"
+		functions[i].StructResult = true
+	}
+	return nil
+}
+
+// fieldTypes maps the kinds of struct fields returned as Go results to C type names.
+var fieldTypes = map[cc.Kind]string{
+	cc.Bool:      "_Bool",
+	cc.Char:      "char",
+	cc.SChar:     "signed char",
+	cc.UChar:     "unsigned char",
+	cc.Int:       "int",
+	cc.UInt:      "uint32_t",
+	cc.Long:      "long",
+	cc.LongLong:  "long long",
+	cc.ULong:     "unsigned long long",
+	cc.ULongLong: "unsigned long long",
+	cc.Float:     "float",
+	cc.Double:    "double",
+	cc.Ptr:       "void *",
+}
+
+// convertResultFields returns the fields of a struct result of at most 16 bytes as
+// Go results. Their offsets in the struct match the Go result frame, since both
+// align scalars to their sizes.
+func convertResultFields(function Function, result cc.Type) ([]Parameter, error) {
+	structType, ok := result.(*cc.StructType)
+	if !ok {
+		return nil, fmt.Errorf("%v: union results of at most 16 bytes are not supported", function.Name)
+	}
+	var results []Parameter
+	for i := 0; i < structType.NumFields(); i++ {
+		field := structType.FieldByIndex(i)
+		typeName, ok := fieldTypes[field.Type().Kind()]
+		if !ok || field.IsBitfield() || field.Name() == "" {
+			return nil, fmt.Errorf("%v: unsupported field of struct result: %v", function.Name, field.Type())
+		}
+		name := goParameterName(field.Name(), i)
+		if slices.ContainsFunc(function.Parameters, func(param Parameter) bool { return param.Name == name }) {
+			return nil, fmt.Errorf("%v: field %v of struct result has the name of a parameter", function.Name, name)
+		}
+		results = append(results, Parameter{Name: name, ParameterType: ParameterType{Type: typeName}})
+	}
+	return results, nil
+}
+
+// cppExtensions are the extensions of C++ sources, of which only extern "C" functions are translated.
+var cppExtensions = []string{".cc", ".cpp", ".cxx"}
+
+var externC = regexp.MustCompile(`^extern\s*"C"\s*`)
+
+// extractExternC blanks out a C++ source, except preprocessor directives and extern "C"
+// declarations, so that it can be parsed as C. The bodies of functions, which may use
+// C++, are emptied. Line breaks are kept so that positions do not change.
+func extractExternC(source []byte) []byte {
+	out := make([]byte, len(source))
+	for i, c := range source {
+		if c == '\n' {
+			out[i] = c
+		} else {
+			out[i] = ' '
+		}
+	}
+	// skip returns the end of the comment or literal at i, or i if there is none
+	skip := func(i int) int {
+		switch {
+		case bytes.HasPrefix(source[i:], []byte("//")):
+			if j := bytes.IndexByte(source[i:], '\n'); j >= 0 {
+				return i + j
+			}
+			return len(source)
+		case bytes.HasPrefix(source[i:], []byte("/*")):
+			if j := bytes.Index(source[i+2:], []byte("*/")); j >= 0 {
+				return i + 2 + j + 2
+			}
+			return len(source)
+		case source[i] == '"' || source[i] == '\'':
+			for j := i + 1; j < len(source); j++ {
+				if source[j] == '\\' {
+					j++
+				} else if source[j] == source[i] || source[j] == '\n' {
+					return j + 1
+				}
+			}
+			return len(source)
+		}
+		return i
+	}
+	// closeBrace returns the index of the brace closing the one at i
+	closeBrace := func(i int) int {
+		depth := 0
+		for i < len(source) {
+			if j := skip(i); j > i {
+				i = j
+				continue
+			}
+			if source[i] == '{' {
+				depth++
+			} else if source[i] == '}' {
+				if depth--; depth == 0 {
+					return i
+				}
+			}
+			i++
+		}
+		return len(source) - 1
+	}
+	// declarations copies the declarations at i, up to the brace closing an extern "C"
+	// block or the end of a single declaration, and returns where they end
+	declarations := func(i int, block bool) int {
+		var last byte
+		depth := 0
+		for i < len(source) {
+			if j := skip(i); j > i {
+				copy(out[i:j], source[i:j])
+				i = j
+				continue
+			}
+			c := source[i]
+			switch {
+			case c == '}' && depth == 0 && block:
+				return i + 1
+			case c == '{' && depth == 0 && last == ')':
+				end := closeBrace(i)
+				out[i], out[end] = '{', '}'
+				if i = end + 1; !block {
+					return i
+				}
+				last = '}'
+				continue
+			case c == '{':
+				depth++
+			case c == '}':
+				depth--
+			case c == ';' && depth == 0 && !block:
+				out[i] = c
+				return i + 1
+			}
+			out[i] = c
+			if c != ' ' && c != '\t' && c != '\r' && c != '\n' {
+				last = c
+			}
+			i++
+		}
+		return i
+	}
+	lineStart := true
+	for i := 0; i < len(source); {
+		if j := skip(i); j > i {
+			i = j
+			continue
+		}
+		switch c := source[i]; {
+		case c == '\n':
+			lineStart = true
+			i++
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case c == '#' && lineStart:
+			// directives, including their continuation lines
+			end := i
+			for end < len(source) && (source[end] != '\n' || source[end-1] == '\\') {
+				end++
+			}
+			copy(out[i:end], source[i:end])
+			i = end
+		default:
+			lineStart = false
+			if match := externC.FindIndex(source[i:]); match != nil && (i == 0 || !isIdentifier(source[i-1])) {
+				if i += match[1]; i < len(source) && source[i] == '{' {
+					i = declarations(i+1, true)
+				} else {
+					i = declarations(i, false)
+				}
+			} else {
+				i++
+			}
+		}
+	}
+	return out
+}
+
+func isIdentifier(c byte) bool {
+	return c == '_' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+// isInline reports whether the function is declared inline.
+func isInline(functionDefinition *cc.FunctionDefinition) bool {
+	for ds := functionDefinition.DeclarationSpecifiers; ds != nil; ds = ds.DeclarationSpecifiers {
+		if ds.Case == cc.DeclarationSpecifiersFunc && ds.FunctionSpecifier.Case == cc.FunctionSpecifierInline {
+			return true
+		}
+	}
+	return false
+}
+
+// isExported reports whether the function is marked to be translated even if it is
+// inline, either by a "// goat:export" comment above it or by __attribute__((used)).
+func isExported(functionDefinition *cc.FunctionDefinition) bool {
+	if tokens := cc.NodeTokens(functionDefinition); len(tokens) > 0 && strings.Contains(string(tokens[0].Sep()), "goat:export") {
+		return true
+	}
+	for ds := functionDefinition.DeclarationSpecifiers; ds != nil; ds = ds.DeclarationSpecifiers {
+		if ds.Case != cc.DeclarationSpecifiersAttr {
+			continue
+		}
+		for list := ds.AttributeSpecifierList; list != nil; list = list.AttributeSpecifierList {
+			for value := list.AttributeSpecifier.AttributeValueList; value != nil; value = value.AttributeValueList {
+				if value.AttributeValue.Token.SrcStr() == "used" {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// unsupportedTypeHints suggest replacements of unsupported types in errors.
+var unsupportedTypeHints = map[string]string{
+	// 80-bit x87 on amd64 and 128-bit on arm64, neither of which Go has
+	"long double":          "use double",
+	"long double _Complex": "use double _Complex",
+	// half precision, which Go has no type for and each ABI passes differently
+	"_Float16":  "use float",
+	"__fp16":    "use float",
+	"float16_t": "use float",
+}
+
+// validate checks that every function signature can be translated, so that
+// unsupported functions fail before clang and objdump are run.
+func (t *TranslateUnit) validate(functions []Function) error {
+	hint := func(typeName string) string {
+		if hint, ok := unsupportedTypeHints[typeName]; ok {
+			return " (" + hint + ")"
+		}
+		return ""
+	}
+	for _, function := range functions {
+		if _, ok := supportedTypes[function.Type]; !ok && function.Type != "void" && len(function.Results) == 0 {
+			return fmt.Errorf("%v:%v: error: %v: unsupported return type: %v%v",
+				t.Source, function.Position, function.Name, function.Type, hint(function.Type))
+		}
+		for _, param := range function.Parameters {
+			if _, ok := supportedTypes[param.Type]; !ok && !param.Pointer {
+				return fmt.Errorf("%v:%v: error: %v: unsupported type of parameter %v: %v%v",
+					t.Source, function.Position, function.Name, param.Name, param.Type, hint(param.Type))
+			}
+		}
+	}
+	return nil
+}
+
 func (t *TranslateUnit) generateGoStubs(functions []Function) error {
 	// generate code
 	var builder strings.Builder
-	builder.WriteString(buildTags)
+	builder.WriteString(t.stubConstraint())
 	t.writeHeader(&builder)
+	if t.EmbedSource {
+		t.writeSource(&builder)
+	}
 	builder.WriteString(fmt.Sprintf("package %v\n", t.Package))
 	if hasPointer(functions) {
 		builder.WriteString("\nimport \"unsafe\"\n")
 	}
 	for _, function := range functions {
-		builder.WriteString("\n//go:noescape\n")
+		builder.WriteRune('\n')
+		for _, param := range function.Parameters {
+			if param.Length > 0 {
+				builder.WriteString(fmt.Sprintf("// %v points to %d elements.\n", param.Name, param.Length))
+			}
+		}
+		if outputs := function.Outputs(); len(outputs) > 0 {
+			// output pointers are left escaping so that the GC keeps what they point to alive
+			builder.WriteString(fmt.Sprintf("// %v writes its results to %v.\n", function.Name, strings.Join(outputs, ", ")))
+		} else if function.Type == "void *" {
+			// the result may point into a parameter, which must not be allocated on the stack of the caller
+			builder.WriteString(fmt.Sprintf("// %v returns a pointer, which may point to what its parameters point to.\n", function.Name))
+		} else {
+			builder.WriteString("//go:noescape\n")
+		}
 		builder.WriteString("func ")
 		builder.WriteString(function.Name)
-		builder.WriteRune('(')
-		for i, param := range function.Parameters {
-			if i > 0 {
-				builder.WriteString(", ")
-			}
-			builder.WriteString(param.Name)
-			if i+1 == len(function.Parameters) || function.Parameters[i+1].String() != param.String() {
-				builder.WriteRune(' ')
-				builder.WriteString(param.String())
-			}
-		}
-		builder.WriteRune(')')
-		if function.Type != "void" {
-			switch function.Type {
-			case "_Bool":
-				builder.WriteString(" (result bool)")
-			case "double":
-				builder.WriteString(" (result float64)")
-			case "float":
-				builder.WriteString(" (result float32)")
-			case "int64_t", "long":
-				builder.WriteString(" (result int64)")
-			default:
-				return fmt.Errorf("unsupported return type: %v", function.Type)
-			}
+		writeParameters(&builder, function.Parameters)
+		if len(function.Results) > 0 {
+			builder.WriteRune(' ')
+			writeParameters(&builder, function.Results)
+		} else if function.Type != "void" {
+			builder.WriteString(fmt.Sprintf(" (result %v)", ParameterType{Type: function.Type}.String()))
 		}
 		builder.WriteRune('\n')
 	}
+	if t.Slices {
+		for _, function := range functions {
+			generateSliceWrapper(&builder, function)
+		}
+	}
 
 	// write file
+	content, err := t.appendGenerated(t.Go, builder.String())
+	if err != nil {
+		return err
+	}
 	f, err := os.Create(t.Go)
 	if err != nil {
 		return err
@@ -166,13 +659,81 @@ func (t *TranslateUnit) generateGoStubs(functions []Function) error {
 			os.Exit(1)
 		}
 	}(f)
-	_, err = f.WriteString(builder.String())
+	_, err = f.WriteString(content)
+	return err
+}
+
+// benchmarkBufferSize is the size of the zeroed buffer passed to each pointer
+// parameter by generated benchmarks.
+const benchmarkBufferSize = 4096
+
+// generateGoBenchmarks writes a benchmark for each function, which calls it with
+// zeroed arguments. It is a skeleton to be filled with meaningful inputs, since
+// zeroed ones may make a kernel do nothing or fault, e.g. dividing by zero.
+func (t *TranslateUnit) generateGoBenchmarks(functions []Function) error {
+	// generate code
+	var builder strings.Builder
+	builder.WriteString(t.stubConstraint())
+	t.writeHeader(&builder)
+	builder.WriteString(fmt.Sprintf("package %v\n", t.Package))
+	if hasPointer(functions) {
+		builder.WriteString("\nimport (\n\t\"testing\"\n\t\"unsafe\"\n)\n")
+	} else {
+		builder.WriteString("\nimport \"testing\"\n")
+	}
+	for _, function := range functions {
+		builder.WriteString(fmt.Sprintf("\nfunc Benchmark%v%v(b *testing.B) {\n",
+			strings.ToUpper(function.Name[:1]), function.Name[1:]))
+		var args []string
+		for i, param := range function.Parameters {
+			if param.Pointer {
+				builder.WriteString(fmt.Sprintf("\targ%d := make([]byte, %d)\n", i, benchmarkBufferSize))
+				args = append(args, fmt.Sprintf("unsafe.Pointer(&arg%d[0])", i))
+			} else if param.Type == "_Bool" {
+				args = append(args, "false")
+			} else {
+				args = append(args, "0")
+			}
+		}
+		builder.WriteString("\tfor i := 0; i < b.N; i++ {\n")
+		builder.WriteString(fmt.Sprintf("\t\t%v(%v)\n", function.Name, strings.Join(args, ", ")))
+		builder.WriteString("\t}\n}\n")
+	}
+
+	// write file
+	content, err := t.appendGenerated(t.Benchmark, builder.String())
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(t.Benchmark)
+	if err != nil {
+		return err
+	}
+	defer func(f *os.File) {
+		if err = f.Close(); err != nil {
+			_, _ = fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}(f)
+	_, err = f.WriteString(content)
 	return err
 }
 
-func (t *TranslateUnit) compile(args ...string) error {
-	args = append(args, "-mno-red-zone", "-mstackrealign", "-mllvm", "-inline-threshold=1000",
-		"-fno-asynchronous-unwind-tables", "-fno-exceptions", "-fno-rtti", "-fno-builtin")
+// compile compiles the source to assembly and assembles it. The options are passed after the
+// defaults, so they can override them, e.g. -fbuiltin.
+func (t *TranslateUnit) compile(ctx context.Context, options ...string) error {
+	var target, args []string
+	if t.Compiler == "gcc" {
+		args = append(args, "-finline-limit=1000", "-fno-asynchronous-unwind-tables", "-fno-exceptions",
+			"-fno-builtin", "-fno-stack-protector")
+		if runtime.GOARCH == "amd64" {
+			args = append(args, "-mno-red-zone", "-mstackrealign")
+		}
+	} else {
+		target = []string{"-target", buildTarget}
+		args = append(args, "-mno-red-zone", "-mstackrealign", "-mllvm", "-inline-threshold=1000",
+			"-fno-asynchronous-unwind-tables", "-fno-exceptions", "-fno-rtti", "-fno-builtin")
+	}
 	if runtime.GOARCH == "arm64" {
 		// R18 is the "platform register", reserved on the Apple platform.
 		// See https://go.dev/doc/asm#arm64
@@ -181,30 +742,141 @@ func (t *TranslateUnit) compile(args ...string) error {
 		// X27 points to the Go routine structure.
 		args = append(args, "-ffixed-x27")
 	}
-	_, err := runCommand("clang", append([]string{"-S", "-target", buildTarget, "-c", t.Source, "-o", t.Assembly}, args...)...)
-	if err != nil {
+	for _, includePath := range t.IncludePaths {
+		args = append(args, "-I"+includePath)
+	}
+	for _, define := range t.Defines {
+		args = append(args, "-D"+define)
+	}
+	if t.Std != "" && !slices.Contains(cppExtensions, filepath.Ext(t.Source)) {
+		// C++ sources are compiled with the C++ standard of the compiler
+		args = append(args, "-std="+t.Std)
+	}
+	args = append(args, options...)
+	compileArgs := slices.Concat([]string{"-S"}, target, []string{"-c", t.Source, "-o", t.Assembly}, args)
+	if _, err := runCommand(ctx, t.Compiler, compileArgs...); err != nil {
+		return fmt.Errorf("failed to compile %v: %v %v\n%w", t.Source, t.Compiler, strings.Join(compileArgs, " "), err)
+	}
+	assembleArgs := slices.Concat(target, []string{"-c", t.Assembly, "-o", t.Object}, args)
+	if _, err := runCommand(ctx, t.Compiler, assembleArgs...); err != nil {
+		return fmt.Errorf("failed to assemble %v: %v %v\n%w", t.Assembly, t.Compiler, strings.Join(assembleArgs, " "), err)
+	}
+	return nil
+}
+
+// generateGoFiles generates the Go stubs and, if requested, the benchmarks.
+func (t *TranslateUnit) generateGoFiles(functions []Function) error {
+	// the assembly is written next to the Go file, so this creates the package directory for both
+	if err := os.MkdirAll(filepath.Dir(t.Go), 0755); err != nil {
 		return err
 	}
-	_, err = runCommand("clang", append([]string{"-target", buildTarget, "-c", t.Assembly, "-o", t.Object}, args...)...)
-	return err
+	functions = t.withSymbolPrefix(functions)
+	if err := t.generateGoStubs(functions); err != nil {
+		return err
+	}
+	if t.Benchmark != "" {
+		return t.generateGoBenchmarks(functions)
+	}
+	return nil
+}
+
+// helperFunction matches the runtime helpers that compilers call to lower builtins
+// and operations, e.g. __powidf2 or memcpy.
+var helperFunction = regexp.MustCompile(`^(__\w+|memcpy|memmove|memset)$`)
+
+// mathFunction matches the functions of libm that compilers lower to instructions
+// unless -fno-builtin, which is always passed, is overridden.
+var mathFunction = regexp.MustCompile(`^(sqrt|fabs|floor|ceil|trunc|round|rint|nearbyint|fma|fmin|fmax|copysign)[fl]?$`)
+
+// findCall describes the first call of a translated function to a function matching
+// target, or returns an empty string if there is none.
+func findCall(functions []Function, assembly map[string][]Line, target *regexp.Regexp) string {
+	for _, function := range functions {
+		for _, line := range assembly[function.Name] {
+			if match := callTarget.FindStringSubmatch(line.Assembly); match != nil && target.MatchString(match[1]) {
+				return fmt.Sprintf("%v calls %v", function.Name, match[1])
+			}
+		}
+	}
+	return ""
+}
+
+// raiseOptimizeLevel returns the options with the optimization level raised by one and
+// the new level, or an empty level if it cannot be raised, e.g. from -O3 or -Os.
+func raiseOptimizeLevel(options []string) ([]string, string) {
+	for i := len(options) - 1; i >= 0; i-- {
+		if !strings.HasPrefix(options[i], "-O") {
+			continue
+		}
+		var level int
+		switch options[i] {
+		case "-O0":
+			level = 1
+		case "-O", "-O1":
+			level = 2
+		case "-O2":
+			level = 3
+		default:
+			return options, ""
+		}
+		raised := slices.Clone(options)
+		raised[i] = fmt.Sprintf("-O%d", level)
+		return raised, raised[i]
+	}
+	return append(slices.Clone(options), "-O1"), "-O1"
 }
 
-func (t *TranslateUnit) Translate() error {
+// Translate translates the source file. The commands it runs are killed when ctx is done.
+func (t *TranslateUnit) Translate(ctx context.Context) error {
 	functions, err := t.parseSource()
 	if err != nil {
 		return err
 	}
-	if err = t.generateGoStubs(functions); err != nil {
+	if err = t.validate(functions); err != nil {
 		return err
 	}
-	if err = t.compile(t.Options...); err != nil {
+	if err = t.generateGoFiles(functions); err != nil {
 		return err
 	}
-	assembly, stackSizes, err := parseAssembly(t.Assembly)
-	if err != nil {
-		return err
+	if t.ParseOnly {
+		for _, function := range functions {
+			_, _ = fmt.Fprintf(t.Out, "%v:%v: %v\n", t.Source, function.Position, function.Name)
+		}
+		return nil
+	}
+	var (
+		assembly   map[string][]Line
+		stackSizes map[string]int
+	)
+	for retried := false; ; retried = true {
+		if err = t.compile(ctx, t.Options...); err != nil {
+			return err
+		}
+		if assembly, stackSizes, err = parseAssembly(t.Assembly); err != nil {
+			return err
+		}
+		// calls to the helpers of builtins, and to libm with -fbuiltin, may be inlined at a higher optimization level
+		call := findCall(functions, assembly, helperFunction)
+		if call == "" && slices.Contains(t.Options, "-fbuiltin") {
+			call = findCall(functions, assembly, mathFunction)
+		}
+		options, level := raiseOptimizeLevel(t.Options)
+		if call == "" || level == "" {
+			if retried {
+				// the flags in the headers must match the assembly
+				if err = t.generateGoFiles(functions); err != nil {
+					return err
+				}
+			}
+			break
+		}
+		_, _ = fmt.Fprintf(os.Stderr, "%v, retrying with %v\n", call, level)
+		t.Options = options
+	}
+	if call := findCall(functions, assembly, mathFunction); call != "" && !slices.Contains(t.Options, "-fbuiltin") {
+		_, _ = fmt.Fprintf(os.Stderr, "warning: %v, which -fno-builtin keeps from being lowered, pass -e -fbuiltin to allow it\n", call)
 	}
-	dump, err := runCommand("objdump", "-d", t.Object, "--insn-width", "16")
+	dump, err := runCommand(ctx, "objdump", t.objdumpArguments()...)
 	if err != nil {
 		return err
 	}
@@ -213,10 +885,133 @@ func (t *TranslateUnit) Translate() error {
 		return err
 	}
 	for i, name := range functions {
+		if _, ok := assembly[name.Name]; !ok {
+			// e.g. inline functions exported without __attribute__((used))
+			return fmt.Errorf("%v: function not found in the assembly generated by clang", name.Name)
+		}
 		functions[i].Lines = assembly[name.Name]
 		functions[i].StackSize = stackSizes[name.Name]
+		if err = checkBinaries(functions[i]); err != nil {
+			return err
+		}
+		if err = checkRedZone(functions[i]); err != nil {
+			return err
+		}
+		if t.Strict {
+			if err = checkInstructions(functions[i]); err != nil {
+				return err
+			}
+		}
+	}
+	if err = t.generateGoAssembly(t.GoAssembly, t.withSymbolPrefix(functions)); err != nil {
+		return err
+	}
+	if t.Manifest != "" {
+		return t.generateManifest(functions)
+	}
+	return nil
+}
+
+// objdumpArguments returns the arguments of objdump, which disassembles the object
+// in the syntax that parseObjectDump expects.
+func (t *TranslateUnit) objdumpArguments() []string {
+	return append([]string{"-d", t.Object, "--insn-width", "16"}, objdumpOptions...)
+}
+
+// withSymbolPrefix returns the functions renamed after their Go symbols, leaving
+// functions named after their C symbols.
+func (t *TranslateUnit) withSymbolPrefix(functions []Function) []Function {
+	if t.SymbolPrefix == "" {
+		return functions
+	}
+	prefixed := slices.Clone(functions)
+	for i := range prefixed {
+		prefixed[i].Name = t.SymbolPrefix + prefixed[i].Name
+	}
+	return prefixed
+}
+
+type ManifestParameter struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	GoType   string `json:"go_type"`
+	Register string `json:"register,omitempty"`
+	Stack    bool   `json:"stack,omitempty"`
+}
+
+type ManifestFunction struct {
+	Name       string              `json:"name"`
+	Symbol     string              `json:"symbol"`
+	Line       int                 `json:"line"`
+	Type       string              `json:"type"`
+	FrameSize  int                 `json:"frame_size"`
+	Parameters []ManifestParameter `json:"parameters"`
+}
+
+// Manifest describes the generated functions, so that changes to their ABI can be
+// spotted by diffing it.
+type Manifest struct {
+	Source    string             `json:"source"`
+	Arch      string             `json:"arch"`
+	Target    string             `json:"target"`
+	Functions []ManifestFunction `json:"functions"`
+}
+
+func (t *TranslateUnit) generateManifest(functions []Function) error {
+	manifest := Manifest{
+		Source: t.Source,
+		Arch:   runtime.GOARCH,
+		Target: buildTarget,
+	}
+	for _, function := range functions {
+		manifestFunction := ManifestFunction{
+			Name:       function.Name,
+			Symbol:     t.Package + "." + t.SymbolPrefix + function.Name,
+			Line:       function.Position,
+			Type:       function.Type,
+			FrameSize:  function.FrameSize,
+			Parameters: make([]ManifestParameter, 0, len(function.Parameters)),
+		}
+		for _, param := range function.Parameters {
+			paramType := param.Type
+			if param.Pointer {
+				paramType += " *"
+			}
+			manifestFunction.Parameters = append(manifestFunction.Parameters, ManifestParameter{
+				Name:     param.Name,
+				Type:     paramType,
+				GoType:   param.String(),
+				Register: param.Register,
+				Stack:    param.Register == "",
+			})
+		}
+		manifest.Functions = append(manifest.Functions, manifestFunction)
+	}
+	if t.Append {
+		if bytes, err := os.ReadFile(t.Manifest); err == nil {
+			var previous Manifest
+			if err = json.Unmarshal(bytes, &previous); err != nil {
+				return fmt.Errorf("failed to append to %v: %w", t.Manifest, err)
+			}
+			// like the generated files, functions are replaced in place or appended
+			functions := previous.Functions
+			for _, function := range manifest.Functions {
+				if i := slices.IndexFunc(functions, func(f ManifestFunction) bool { return f.Symbol == function.Symbol }); i >= 0 {
+					functions[i] = function
+				} else {
+					functions = append(functions, function)
+				}
+			}
+			manifest.Functions = functions
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	bytes, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
 	}
-	return t.generateGoAssembly(t.GoAssembly, functions)
+	return os.WriteFile(t.Manifest, append(bytes, '\n'), 0644)
 }
 
 type ParameterType struct {
@@ -231,12 +1026,28 @@ func (p ParameterType) String() string {
 	switch p.Type {
 	case "_Bool":
 		return "bool"
-	case "int64_t", "long":
+	case "int64_t", "long", "long long", "ssize_t", "ptrdiff_t", "intptr_t":
 		return "int64"
+	case "unsigned long long", "size_t", "uintptr_t":
+		return "uint64"
+	case "int", "int32_t":
+		return "int32"
+	case "uint32_t":
+		return "uint32"
+	case "char", "signed char":
+		return "int8"
+	case "unsigned char":
+		return "uint8"
 	case "double":
 		return "float64"
 	case "float":
 		return "float32"
+	case "float _Complex":
+		return "complex64"
+	case "double _Complex":
+		return "complex128"
+	case "void *":
+		return "unsafe.Pointer"
 	default:
 		_, _ = fmt.Fprintln(os.Stderr, "unsupported param type:", p.Type)
 		os.Exit(1)
@@ -244,9 +1055,31 @@ func (p ParameterType) String() string {
 	}
 }
 
+// Align returns the alignment of the parameter in the Go argument frame. Complex
+// numbers are aligned like their parts.
+func (p ParameterType) Align() int {
+	if p.Pointer {
+		return 8
+	}
+	if part, ok := complexTypes[p.Type]; ok {
+		return supportedTypes[part]
+	}
+	return supportedTypes[p.Type]
+}
+
 type Parameter struct {
 	Name string
 	ParameterType
+	// Register is where the parameter is passed to the C function, or empty if it is on the stack.
+	Register string
+	// Length is the number of elements that the pointer points to, set by a goat:length pragma.
+	Length int
+}
+
+// IsOutput reports whether the parameter is an output pointer, which is named
+// with an out_ prefix or an _out suffix.
+func (p Parameter) IsOutput() bool {
+	return p.Pointer && (strings.HasPrefix(p.Name, "out_") || strings.HasSuffix(p.Name, "_out"))
 }
 
 type Function struct {
@@ -255,17 +1088,61 @@ type Function struct {
 	Type       string
 	Parameters []Parameter
 	Lines      []Line
-	StackSize  int
+	// StackSize is the stack that the C code allocates, or -1 if it is only known at run time.
+	StackSize int
+	// Results are the fields of a struct result of at most 16 bytes, which is returned in registers.
+	Results []Parameter
+	// StructResult is set if the first parameter is the hidden pointer to a struct result.
+	StructResult bool
+	// FrameSize is the frame size of the generated TEXT directive.
+	FrameSize int
+}
+
+// ResultSize returns the size of the results in the Go argument frame.
+func (f Function) ResultSize() int {
+	if len(f.Results) == 0 {
+		return supportedTypes[f.Type]
+	}
+	offsets := f.ResultOffsets()
+	return offsets[len(offsets)-1] + supportedTypes[f.Results[len(f.Results)-1].Type]
+}
+
+// ResultOffsets returns the offsets of the results from the start of the results.
+func (f Function) ResultOffsets() []int {
+	var offsets []int
+	offset := 0
+	for _, result := range f.Results {
+		if align := result.Align(); offset%align != 0 {
+			offset += align - offset%align
+		}
+		offsets = append(offsets, offset)
+		offset += supportedTypes[result.Type]
+	}
+	return offsets
+}
+
+// Outputs returns the names of output pointer parameters.
+func (f Function) Outputs() []string {
+	var outputs []string
+	for i, param := range f.Parameters {
+		if param.IsOutput() || (i == 0 && f.StructResult) {
+			outputs = append(outputs, param.Name)
+		}
+	}
+	return outputs
 }
 
 // convertFunction extracts the function definition from cc.DirectDeclarator.
 func (t *TranslateUnit) convertFunction(functionDefinition *cc.FunctionDefinition) (Function, error) {
 	// parse return type
 	declarationSpecifiers := functionDefinition.DeclarationSpecifiers
-	if declarationSpecifiers.Case != cc.DeclarationSpecifiersTypeSpec {
+	returnType := convertDeclarationSpecifiers(declarationSpecifiers)
+	if functionDefinition.Declarator.Pointer != nil {
+		// pointer results are returned as unsafe.Pointer, whatever they point to
+		returnType = "void *"
+	} else if returnType == "" {
 		return Function{}, fmt.Errorf("invalid function return type: %v", declarationSpecifiers.Case)
 	}
-	returnType := declarationSpecifiers.TypeSpecifier.Token.SrcStr()
 	// parse parameters
 	directDeclarator := functionDefinition.Declarator.DirectDeclarator
 	if directDeclarator.Case != cc.DirectDeclaratorFuncParam {
@@ -285,42 +1162,144 @@ func (t *TranslateUnit) convertFunction(functionDefinition *cc.FunctionDefinitio
 
 // convertFunctionParameters extracts function parameters from cc.ParameterList.
 func (t *TranslateUnit) convertFunctionParameters(params *cc.ParameterList) ([]Parameter, error) {
-	declaration := params.ParameterDeclaration
-	paramName := declaration.Declarator.DirectDeclarator.Token.SrcStr()
-	var paramType string
-	if declaration.DeclarationSpecifiers.Case == cc.DeclarationSpecifiersTypeQual {
-		paramType = declaration.DeclarationSpecifiers.DeclarationSpecifiers.TypeSpecifier.Token.SrcStr()
-	} else {
-		paramType = declaration.DeclarationSpecifiers.TypeSpecifier.Token.SrcStr()
-	}
-	isPointer := declaration.Declarator.Pointer != nil
-	if _, ok := supportedTypes[paramType]; !ok && !isPointer {
-		position := declaration.Position()
-		return nil, fmt.Errorf("%v:%v:%v: error: unsupported type: %v",
-			position.Filename, position.Line+t.Offset, position.Column, paramType)
-	}
-	paramNames := []Parameter{{
-		Name: paramName,
-		ParameterType: ParameterType{
-			Type:    paramType,
-			Pointer: isPointer,
-		},
-	}}
-	if params.ParameterList != nil {
-		if nextParamNames, err := t.convertFunctionParameters(params.ParameterList); err != nil {
-			return nil, err
-		} else {
-			paramNames = append(paramNames, nextParamNames...)
+	var paramNames []Parameter
+	for ; params != nil; params = params.ParameterList {
+		declaration := params.ParameterDeclaration
+		paramType := convertDeclarationSpecifiers(declaration.DeclarationSpecifiers)
+		var paramName string
+		var isPointer bool
+		if declaration.Declarator != nil {
+			directDeclarator := declaration.Declarator.DirectDeclarator
+			isPointer = declaration.Declarator.Pointer != nil
+			// array parameters, such as float a[restrict 4], are pointers
+			for isArrayDeclarator(directDeclarator) {
+				directDeclarator = directDeclarator.DirectDeclarator
+				isPointer = true
+			}
+			paramName = directDeclarator.Token.SrcStr()
+		} else if declaration.AbstractDeclarator != nil {
+			// arrays and functions without a name decay to pointers too
+			isPointer = declaration.AbstractDeclarator.Pointer != nil || declaration.AbstractDeclarator.DirectAbstractDeclarator != nil
+		} else if paramType == "void" && len(paramNames) == 0 && params.ParameterList == nil {
+			// f(void) has no parameters
+			break
 		}
+		paramNames = append(paramNames, Parameter{
+			Name: goParameterName(paramName, len(paramNames)),
+			ParameterType: ParameterType{
+				Type:    paramType,
+				Pointer: isPointer,
+			},
+		})
 	}
 	return paramNames, nil
 }
 
+// isArrayDeclarator reports whether the declarator declares an array.
+func isArrayDeclarator(directDeclarator *cc.DirectDeclarator) bool {
+	switch directDeclarator.Case {
+	case cc.DirectDeclaratorArr, cc.DirectDeclaratorStaticArr, cc.DirectDeclaratorArrStatic, cc.DirectDeclaratorStar:
+		return true
+	default:
+		return false
+	}
+}
+
+// goParameterName returns the name of the i-th parameter in the Go stub and assembly.
+// Unnamed parameters are named argN, and names that are Go keywords, that collide
+// with the result or that the Go assembler reads as a register get an underscore.
+func goParameterName(name string, i int) string {
+	if name == "" {
+		return fmt.Sprintf("arg%d", i)
+	}
+	if token.IsKeyword(name) || name == "result" || pseudoRegister.MatchString(name) || registerName.MatchString(name) {
+		return name + "_"
+	}
+	return name
+}
+
+// convertDeclarationSpecifiers returns the C type name of cc.DeclarationSpecifiers.
+// Adjacent type specifiers such as unsigned long long are joined and qualifiers are skipped.
+func convertDeclarationSpecifiers(declarationSpecifiers *cc.DeclarationSpecifiers) string {
+	var names []string
+	for ; declarationSpecifiers != nil; declarationSpecifiers = declarationSpecifiers.DeclarationSpecifiers {
+		if declarationSpecifiers.Case == cc.DeclarationSpecifiersTypeSpec {
+			names = append(names, convertTypeSpecifier(declarationSpecifiers.TypeSpecifier))
+		}
+	}
+	// _Complex float is the same type as float _Complex
+	if len(names) == 2 && names[0] == "_Complex" {
+		names[0], names[1] = names[1], names[0]
+	}
+	return strings.Join(names, " ")
+}
+
+// convertTypeSpecifier returns the C type name of cc.TypeSpecifier. Enums are
+// converted to int, which clang uses to store them unless their values do not fit.
+func convertTypeSpecifier(typeSpecifier *cc.TypeSpecifier) string {
+	switch typeSpecifier.Case {
+	case cc.TypeSpecifierEnum:
+		return "int"
+	case cc.TypeSpecifierStructOrUnion:
+		structOrUnion := typeSpecifier.StructOrUnionSpecifier
+		return structOrUnion.StructOrUnion.Token.SrcStr() + " " + structOrUnion.Token.SrcStr()
+	case cc.TypeSpecifierAtomic:
+		// _Atomic(long) is passed like long, but _Atomic(long *) is not supported
+		typeName := typeSpecifier.AtomicTypeSpecifier.TypeName
+		if typeName.AbstractDeclarator != nil {
+			return ""
+		}
+		var names []string
+		for list := typeName.SpecifierQualifierList; list != nil; list = list.SpecifierQualifierList {
+			if list.Case == cc.SpecifierQualifierListTypeSpec {
+				names = append(names, convertTypeSpecifier(list.TypeSpecifier))
+			}
+		}
+		return strings.Join(names, " ")
+	default:
+		return typeSpecifier.Token.SrcStr()
+	}
+}
+
+// buildConstraint returns the build constraint line of generated files.
+func (t *TranslateUnit) buildConstraint() string {
+	if t.BuildTags == nil {
+		return buildTags
+	}
+	// the constraint of the target architecture is always valid
+	expr, _ := constraint.Parse(strings.TrimSpace(buildTags))
+	return "//go:build " + (&constraint.AndExpr{X: expr, Y: t.BuildTags}).String() + "\n"
+}
+
+// stubConstraint returns the build constraint of the Go stubs, which is that of the
+// assembly unless they are shared by StubArchs, e.g. !noasm && (amd64 || arm64).
+func (t *TranslateUnit) stubConstraint() string {
+	if len(t.StubArchs) == 0 {
+		return t.buildConstraint()
+	}
+	var archs constraint.Expr
+	for _, arch := range t.StubArchs {
+		if archs == nil {
+			archs = &constraint.TagExpr{Tag: arch}
+		} else {
+			archs = &constraint.OrExpr{X: archs, Y: &constraint.TagExpr{Tag: arch}}
+		}
+	}
+	// like the build constraints of the assembly, without its architecture
+	var expr constraint.Expr = &constraint.AndExpr{X: &constraint.NotExpr{X: &constraint.TagExpr{Tag: "noasm"}}, Y: archs}
+	if t.BuildTags != nil {
+		expr = &constraint.AndExpr{X: expr, Y: t.BuildTags}
+	}
+	return "//go:build " + expr.String() + "\n"
+}
+
 func (t *TranslateUnit) writeHeader(builder *strings.Builder) {
-	builder.WriteString("// Code generated by GoAT. DO NOT EDIT.\n")
-	builder.WriteString("// versions:\n")
-	builder.WriteString(fmt.Sprintf("// 	clang   %s\n", fetchVersion("clang")))
-	builder.WriteString(fmt.Sprintf("// 	objdump %s\n", fetchVersion("objdump")))
+	builder.WriteString(generatedHeader)
+	if !t.ParseOnly {
+		builder.WriteString("// versions:\n")
+		builder.WriteString(fmt.Sprintf("// 	%-7s %s\n", t.Compiler, fetchVersion(t.Compiler)))
+		builder.WriteString(fmt.Sprintf("// 	objdump %s\n", fetchVersion("objdump")))
+	}
 	builder.WriteString("// flags:")
 	for _, option := range t.Options {
 		builder.WriteString(" ")
@@ -328,18 +1307,249 @@ func (t *TranslateUnit) writeHeader(builder *strings.Builder) {
 	}
 	builder.WriteRune('\n')
 	builder.WriteString(fmt.Sprintf("// source: %v\n", t.Source))
+	if t.EmbedSource {
+		builder.WriteString(fmt.Sprintf("// sha256: %x\n", sha256.Sum256(t.sourceCode)))
+	}
+	builder.WriteRune('\n')
+}
+
+// sourceCodeHeader starts the comment of an embedded source, followed by its path.
+const sourceCodeHeader = "// source code of"
+
+// writeSource writes the source as a comment, separated from the package clause.
+func (t *TranslateUnit) writeSource(builder *strings.Builder) {
+	builder.WriteString(fmt.Sprintf("%v %v:\n//\n", sourceCodeHeader, t.Source))
+	for _, line := range strings.Split(strings.TrimRight(string(t.sourceCode), "\n"), "\n") {
+		if line = strings.TrimRight(line, " \t\r"); line == "" {
+			builder.WriteString("//\n")
+		} else {
+			builder.WriteString("//\t" + line + "\n")
+		}
+	}
 	builder.WriteRune('\n')
 }
 
-// runCommand runs a command and extract its output.
-func runCommand(name string, arg ...string) (string, error) {
+const generatedHeader = "// Code generated by GoAT. DO NOT EDIT.\n"
+
+// generatedBlock matches the function declared by a block of a generated file:
+// a stub, a benchmark or a TEXT directive.
+var generatedBlock = regexp.MustCompile(`(?m)^(?:func |TEXT ·)(\w+)\(`)
+
+// appendGenerated merges the content generated for path with the existing file in
+// append mode. Generated files are split at blank lines into a preamble, such as
+// the header and the imports, and one block per function, which starts with the
+// declaration of the function. Blocks of the existing file are kept unless the new
+// content declares the same function, in which case they are replaced in place.
+// The preamble is taken from the new content.
+func (t *TranslateUnit) appendGenerated(path, content string) (string, error) {
+	if !t.Append {
+		return content, nil
+	}
+	existing, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return content, nil
+	} else if err != nil {
+		return "", err
+	} else if !strings.Contains(string(existing), generatedHeader) {
+		return "", fmt.Errorf("failed to append to %v: not generated by GoAT", path)
+	}
+	split := func(s string) (preamble []string, blocks map[string]string, names []string) {
+		blocks = make(map[string]string)
+		for _, block := range strings.Split(strings.TrimRight(s, "\n"), "\n\n") {
+			if match := generatedBlock.FindStringSubmatch(block); match != nil {
+				blocks[match[1]] = block
+				names = append(names, match[1])
+			} else if len(names) == 0 {
+				preamble = append(preamble, block)
+			} else {
+				// e.g. a label of the last function, which asmfmt separates with a blank line
+				blocks[names[len(names)-1]] += "\n\n" + block
+			}
+		}
+		return
+	}
+	oldPreamble, oldBlocks, oldNames := split(string(existing))
+	preamble, blocks, names := split(content)
+	preamble = mergePreambles(oldPreamble, preamble)
+	var merged []string
+	for _, name := range oldNames {
+		if block, ok := blocks[name]; ok {
+			merged = append(merged, block)
+		} else {
+			merged = append(merged, oldBlocks[name])
+		}
+	}
+	for _, name := range names {
+		if _, ok := oldBlocks[name]; !ok {
+			merged = append(merged, blocks[name])
+		}
+	}
+	// kept blocks may need the unsafe import that the new functions do not
+	if body := strings.Join(merged, "\n\n"); strings.Contains(body, "unsafe.") &&
+		!slices.ContainsFunc(preamble, func(block string) bool { return strings.Contains(block, `"unsafe"`) }) {
+		for i, block := range preamble {
+			if strings.HasPrefix(block, "import") {
+				preamble = slices.Delete(preamble, i, i+1)
+				break
+			}
+		}
+		for _, block := range oldPreamble {
+			if strings.HasPrefix(block, "import") {
+				preamble = append(preamble, block)
+			}
+		}
+	}
+	return strings.Join(slices.Concat(preamble, merged), "\n\n") + "\n", nil
+}
+
+// mergePreambles returns the preamble of newly generated content with the sources of the
+// existing preamble that were not regenerated, so that the header of an appended file, and
+// its embedded source code, cover the sources of all its functions.
+func mergePreambles(existing, preamble []string) []string {
+	var merged []string
+	for _, block := range preamble {
+		if strings.Contains(block, generatedHeader) {
+			if i := slices.IndexFunc(existing, func(old string) bool { return strings.Contains(old, generatedHeader) }); i >= 0 {
+				block = mergeSources(existing[i], block)
+			}
+		} else if strings.HasPrefix(block, sourceCodeHeader) {
+			for _, old := range existing {
+				first, _, _ := strings.Cut(old, "\n")
+				if strings.HasPrefix(old, sourceCodeHeader) && !slices.ContainsFunc(preamble, func(block string) bool {
+					return strings.HasPrefix(block, first+"\n")
+				}) {
+					merged = append(merged, old)
+				}
+			}
+		}
+		merged = append(merged, block)
+	}
+	return merged
+}
+
+// sourceLine matches the path of a source in a header, which is followed by its SHA-256
+// if the source is embedded.
+var sourceLine = regexp.MustCompile(`^// source: (.+)$`)
+
+// mergeSources returns the header with the sources of the existing header that it lacks,
+// listed before its own.
+func mergeSources(existing, header string) string {
+	parse := func(header string) (sources map[string][]string, names []string) {
+		sources = make(map[string][]string)
+		for _, line := range strings.Split(header, "\n") {
+			if match := sourceLine.FindStringSubmatch(line); match != nil {
+				sources[match[1]] = []string{line}
+				names = append(names, match[1])
+			} else if strings.HasPrefix(line, "// sha256: ") && len(names) > 0 {
+				name := names[len(names)-1]
+				sources[name] = append(sources[name], line)
+			}
+		}
+		return
+	}
+	oldSources, oldNames := parse(existing)
+	sources, _ := parse(header)
+	var merged []string
+	inserted := false
+	for _, line := range strings.Split(header, "\n") {
+		if !inserted && sourceLine.MatchString(line) {
+			for _, name := range oldNames {
+				if _, ok := sources[name]; !ok {
+					merged = append(merged, oldSources[name]...)
+				}
+			}
+			inserted = true
+		}
+		merged = append(merged, line)
+	}
+	return strings.Join(merged, "\n")
+}
+
+var (
+	// symbolReference matches a reference to a symbol in Go assembly, e.g. ·add(SB) or CPI0<>+8(SB).
+	symbolReference = regexp.MustCompile(`([^\s,$()]+?)(?:[+-]\d+)?\(SB\)`)
+	// symbolDefinition matches a directive that defines a symbol.
+	symbolDefinition = regexp.MustCompile(`^\s*(?:TEXT|GLOBL)\s+([^\s,$()]+?)\(SB\)`)
+	// dependencyClasses are the unsafe instruction classes that reference symbols,
+	// whose relocations are lost in the machine code.
+	dependencyClasses = []string{"call", "PC-relative reference", "absolute address", "thread-local reference"}
+)
+
+// verifySelfContained returns an error if the generated assembly references a symbol
+// that it does not define, or if the machine code of an instruction, commented with
+// the instruction, depended on a relocation, e.g. for a call or a constant pool.
+func (t *TranslateUnit) verifySelfContained(assembly []byte) error {
+	lines := strings.Split(string(assembly), "\n")
+	defined := make(map[string]bool)
+	for _, line := range lines {
+		if match := symbolDefinition.FindStringSubmatch(line); match != nil {
+			defined[match[1]] = true
+		}
+	}
+	for i, line := range lines {
+		code, comment, _ := strings.Cut(line, "//")
+		for _, match := range symbolReference.FindAllStringSubmatch(code, -1) {
+			if !defined[match[1]] {
+				return fmt.Errorf("%v:%d: not self-contained: reference to %v", t.GoAssembly, i+1, match[1])
+			}
+		}
+		if strings.TrimSpace(code) == "" {
+			continue
+		}
+		instruction := strings.TrimSpace(comment)
+		for _, class := range unsafeInstructions {
+			if slices.Contains(dependencyClasses, class.Name) && class.Pattern.MatchString(instruction) {
+				return fmt.Errorf("%v:%d: not self-contained: %v: %v", t.GoAssembly, i+1, class.Name, instruction)
+			}
+		}
+	}
+	return nil
+}
+
+// postProcess applies AsmPostProcess, if set, to the formatted assembly.
+func (t *TranslateUnit) postProcess(assembly []byte) ([]byte, error) {
+	if t.AsmPostProcess == nil {
+		return assembly, nil
+	}
+	processed, err := t.AsmPostProcess(string(assembly))
+	if err != nil {
+		return nil, fmt.Errorf("failed to post-process %v: %w", t.GoAssembly, err)
+	}
+	return []byte(processed), nil
+}
+
+// pipeCommand returns a post-processing function that pipes the assembly through a
+// command, given as space-separated arguments, and takes its standard output.
+func pipeCommand(ctx context.Context, command string) func(string) (string, error) {
+	return func(assembly string) (string, error) {
+		args := strings.Fields(command)
+		if len(args) == 0 {
+			return "", errors.New("empty post-processing command")
+		}
+		cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+		cmd.Stdin = strings.NewReader(assembly)
+		cmd.Stderr = os.Stderr
+		output, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("%v: %w", command, err)
+		}
+		return string(output), nil
+	}
+}
+
+// runCommand runs a command and extract its output. The command is killed when ctx is done.
+func runCommand(ctx context.Context, name string, arg ...string) (string, error) {
 	if verbose {
 		fmt.Fprintf(os.Stderr, "Running %v\n", append([]string{name}, arg...))
 	}
-	cmd := exec.Command(name, arg...)
+	cmd := exec.CommandContext(ctx, name, arg...)
+	// stop waiting for subprocesses, such as cc1 of clang, that keep the output open
+	cmd.WaitDelay = time.Second
 	output, err := cmd.CombinedOutput()
 	if err != nil {
-		if output != nil {
+		if ctx.Err() != nil {
+			return "", fmt.Errorf("%v: %w", name, ctx.Err())
+		} else if output != nil {
 			return "", errors.New(string(output))
 		} else {
 			return "", err
@@ -349,12 +1559,14 @@ func runCommand(name string, arg ...string) (string, error) {
 }
 
 func fetchVersion(command string) string {
-	version, err := runCommand(command, "--version")
+	version, err := runCommand(context.Background(), command, "--version")
 	if err != nil {
 		_, _ = fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
 	version = strings.Split(version, "\n")[0]
+	// skip the vendor in parentheses before the version, e.g. gcc (Debian 12.2.0-14) 12.2.0
+	version = regexp.MustCompile(`^[^(\d]*\([^)]*\)`).ReplaceAllString(version, "")
 	loc := regexp.MustCompile(`\d`).FindStringIndex(version)
 	if loc == nil {
 		_, _ = fmt.Fprintln(os.Stderr, "failed to fetch version")
@@ -363,8 +1575,222 @@ func fetchVersion(command string) string {
 	return version[loc[0]:]
 }
 
+// splitObjectDumpLine splits a line of objdump into the instruction bytes and the
+// assembly. The address ends with the first colon and the bytes with the first tab,
+// so instructions without operands are split like any other.
+func splitObjectDumpLine(line string) ([]string, string) {
+	_, data, _ := strings.Cut(line, ":")
+	data = strings.TrimLeft(data, " \t")
+	binary, assembly, _ := strings.Cut(data, "\t")
+	return strings.Fields(binary), strings.TrimSpace(assembly)
+}
+
+// nopPrefixes are the prefixes that objdump prints before the multi-byte nops of amd64,
+// e.g. "data16 cs nopw 0x0(%rax,%rax,1)".
+var nopPrefixes = map[string]bool{"data16": true, "data32": true, "cs": true, "ds": true, "rex": true, "rex.W": true}
+
+// isNop reports whether the instruction, as written by the compiler or printed by objdump,
+// is a nop, which compilers emit as padding to align functions and loops.
+func isNop(asm string) bool {
+	fields := strings.Fields(asm)
+	for len(fields) > 0 && nopPrefixes[fields[0]] {
+		fields = fields[1:]
+	}
+	if len(fields) == 0 {
+		return false
+	}
+	switch fields[0] {
+	case "nop", "nopl", "nopw", "nopq", "c.nop":
+		return true
+	case "xchg", "xchgw":
+		// the two-byte nop 66 90
+		return strings.Join(fields[1:], "") == "%ax,%ax"
+	case "hint":
+		// the arm64 nop, which is hint #0
+		return strings.Join(fields[1:], "") == "#0"
+	}
+	return false
+}
+
+// addArchSuffix inserts the target architecture before the file extension,
+// e.g. add.s becomes add_amd64.s.
+func addArchSuffix(path string) string {
+	ext := filepath.Ext(path)
+	return path[:len(path)-len(ext)] + "_" + runtime.GOARCH + ext
+}
+
+// outputPackage returns the package of the Go stub and the assembly, which must be in the
+// same directory, since the assembly implements the functions that the stub declares.
+func outputPackage(goPath, asmPath string) (string, error) {
+	goDir, err := filepath.Abs(filepath.Dir(goPath))
+	if err != nil {
+		return "", err
+	}
+	if asmDir, err := filepath.Abs(filepath.Dir(asmPath)); err != nil {
+		return "", err
+	} else if asmDir != goDir {
+		return "", fmt.Errorf("%v and %v must be in the same package directory", goPath, asmPath)
+	}
+	return filepath.Base(goDir), nil
+}
+
+// configName is the name of the config file looked up in the directory of the source.
+const configName = ".goat.json"
+
+// loadConfig sets the flags not given on the command line from a JSON object keyed by flag
+// names, e.g. {"machine-option": ["avx2"], "optimize-level": 3}. If path is empty, the config
+// file next to the source is used if it exists.
+func loadConfig(flags *pflag.FlagSet, path, source string) error {
+	if path == "" {
+		path = filepath.Join(filepath.Dir(source), configName)
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return nil
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var config map[string]any
+	if err = json.Unmarshal(data, &config); err != nil {
+		return fmt.Errorf("%v: %w", path, err)
+	}
+	for name, value := range config {
+		flag := flags.Lookup(name)
+		if flag == nil || name == "config" {
+			return fmt.Errorf("%v: unknown flag %q", path, name)
+		}
+		if flag.Changed {
+			continue
+		}
+		if values, ok := value.([]any); ok {
+			sliceValue, ok := flag.Value.(pflag.SliceValue)
+			if !ok {
+				return fmt.Errorf("%v: flag %q does not take a list", path, name)
+			}
+			if err = sliceValue.Replace(lo.Map(values, func(v any, _ int) string { return fmt.Sprint(v) })); err != nil {
+				return fmt.Errorf("%v: flag %q: %w", path, name, err)
+			}
+		} else if err = flag.Value.Set(fmt.Sprint(value)); err != nil {
+			return fmt.Errorf("%v: flag %q: %w", path, name, err)
+		}
+	}
+	return nil
+}
+
+// lengthNames are the names of parameters passing the length of the pointers before them.
+var lengthNames = []string{"n", "len", "length", "count", "size"}
+
+// generateSliceWrapper writes a wrapper of the function, named with a _slice suffix, that
+// takes slices instead of pointers to supported types, if it has any. A run of such
+// pointers followed by an integer parameter named like lengthNames, alone or after the
+// name of the last pointer and an underscore, e.g. x_len, is passed the length of the
+// first slice, and the other slices of the run are resliced to it.
+func generateSliceWrapper(builder *strings.Builder, function Function) {
+	isSlice := func(param Parameter) bool {
+		_, ok := supportedTypes[param.Type]
+		return param.Pointer && ok
+	}
+	if !slices.ContainsFunc(function.Parameters, isSlice) {
+		return
+	}
+	isLength := func(i int) bool {
+		param := function.Parameters[i]
+		if param.Pointer || i == 0 || !isSlice(function.Parameters[i-1]) {
+			return false
+		}
+		if goType := param.String(); !strings.HasPrefix(goType, "int") && !strings.HasPrefix(goType, "uint") {
+			return false
+		}
+		return slices.ContainsFunc(lengthNames, func(name string) bool {
+			return param.Name == name || param.Name == function.Parameters[i-1].Name+"_"+name
+		})
+	}
+	var params []lo.Tuple2[string, string]
+	var args, body, run []string
+	hasLength := false
+	for i, param := range function.Parameters {
+		if isSlice(param) {
+			params = append(params, lo.T2(param.Name, "[]"+ParameterType{Type: param.Type}.String()))
+			if param.Length > 0 {
+				// a shorter slice panics instead of being read out of bounds
+				body = append(body, fmt.Sprintf("%v = %v[:%d]", param.Name, param.Name, param.Length))
+			}
+			args = append(args, fmt.Sprintf("unsafe.Pointer(unsafe.SliceData(%v))", param.Name))
+			run = append(run, param.Name)
+			continue
+		}
+		if isLength(i) {
+			hasLength = true
+			body = append(body, fmt.Sprintf("%v := len(%v)", param.Name, run[0]))
+			for _, name := range run[1:] {
+				body = append(body, fmt.Sprintf("%v = %v[:%v]", name, name, param.Name))
+			}
+			args = append(args, fmt.Sprintf("%v(%v)", param.String(), param.Name))
+		} else {
+			params = append(params, lo.T2(param.Name, param.String()))
+			args = append(args, param.Name)
+		}
+		run = nil
+	}
+	wrapper := function.Name + "_slice"
+	if hasLength {
+		builder.WriteString(fmt.Sprintf("\n// %v calls %v with slices instead of pointers and their lengths.\n", wrapper, function.Name))
+	} else {
+		builder.WriteString(fmt.Sprintf("\n// %v calls %v with slices instead of pointers.\n", wrapper, function.Name))
+	}
+	builder.WriteString(fmt.Sprintf("func %v(", wrapper))
+	for i, param := range params {
+		if i > 0 {
+			builder.WriteString(", ")
+		}
+		builder.WriteString(param.A)
+		if i+1 == len(params) || params[i+1].B != param.B {
+			builder.WriteString(" " + param.B)
+		}
+	}
+	builder.WriteRune(')')
+	if len(function.Results) > 0 {
+		builder.WriteRune(' ')
+		writeParameters(builder, function.Results)
+	} else if function.Type != "void" {
+		builder.WriteString(" " + ParameterType{Type: function.Type}.String())
+	}
+	builder.WriteString(" {\n")
+	for _, line := range body {
+		builder.WriteString("\t" + line + "\n")
+	}
+	call := fmt.Sprintf("%v(%v)", function.Name, strings.Join(args, ", "))
+	if function.Type != "void" {
+		call = "return " + call
+	}
+	builder.WriteString("\t" + call + "\n}\n")
+}
+
+// writeParameters writes a parenthesized Go parameter list, in which adjacent
+// parameters of the same type share it.
+func writeParameters(builder *strings.Builder, params []Parameter) {
+	builder.WriteRune('(')
+	for i, param := range params {
+		if i > 0 {
+			builder.WriteString(", ")
+		}
+		builder.WriteString(param.Name)
+		if i+1 == len(params) || params[i+1].String() != param.String() {
+			builder.WriteRune(' ')
+			builder.WriteString(param.String())
+		}
+	}
+	builder.WriteRune(')')
+}
+
 func hasPointer(functions []Function) bool {
 	for _, function := range functions {
+		if function.Type == "void *" || slices.ContainsFunc(function.Results, func(result Parameter) bool {
+			return result.Type == "void *"
+		}) {
+			return true
+		}
 		for _, param := range function.Parameters {
 			if param.Pointer {
 				return true
@@ -376,10 +1802,201 @@ func hasPointer(functions []Function) bool {
 
 var verbose bool
 
+// pseudoRegister matches the names that the Go assembler reserves on every architecture.
+var pseudoRegister = regexp.MustCompile(`^(g|SB|FP|PC|SP)$`)
+
+// checkExternalReference returns an error if the instruction references global or
+// thread-local data through a relocation, which has no symbol to resolve against
+// in Go assembly.
+func checkExternalReference(functionName, asm string) error {
+	if relocation := externalReference.FindString(asm); relocation != "" {
+		return fmt.Errorf("%v: unsupported reference to external state (%v): %v", functionName, relocation, asm)
+	}
+	return nil
+}
+
+// writeResult stores the result of a function that is not a struct. Integers and pointers
+// are returned in integerRegister and floating-point numbers in the first of fpRegisters,
+// or in the first two if they are complex, one for each part, unless floatStores packs
+// the complex type in one register.
+func writeResult(builder *strings.Builder, function Function, offset int, integerRegister string, fpRegisters []string) {
+	if store, ok := floatStores[function.Type]; ok {
+		builder.WriteString(fmt.Sprintf("\t%s %s, result+%d(FP)\n", store, fpRegisters[0], offset))
+	} else if part, ok := complexTypes[function.Type]; ok {
+		store := floatStores[part]
+		builder.WriteString(fmt.Sprintf("\t%s %s, result_real+%d(FP)\n", store, fpRegisters[0], offset))
+		builder.WriteString(fmt.Sprintf("\t%s %s, result_imag+%d(FP)\n", store, fpRegisters[1], offset+supportedTypes[part]))
+	} else {
+		builder.WriteString(fmt.Sprintf("\t%s %s, result+%d(FP)\n", integerStores[supportedTypes[function.Type]], integerRegister, offset))
+	}
+}
+
+// writeFunctionComment writes the C signature of the function and where each parameter
+// is passed to it, in the registers loaded from the Go arguments or on the stack.
+func writeFunctionComment(builder *strings.Builder, function Function) {
+	cType := func(param ParameterType) string {
+		if param.Pointer {
+			return param.Type + " *"
+		}
+		return param.Type + " "
+	}
+	params := lo.Map(function.Parameters, func(param Parameter, _ int) string {
+		return cType(param.ParameterType) + param.Name
+	})
+	builder.WriteString(fmt.Sprintf("// %v%v(%v)\n", cType(ParameterType{Type: function.Type}), function.Name, strings.Join(params, ", ")))
+	for _, param := range function.Parameters {
+		if param.Register != "" {
+			builder.WriteString(fmt.Sprintf("//   %v: %v\n", param.Name, param.Register))
+		} else {
+			builder.WriteString(fmt.Sprintf("//   %v: stack\n", param.Name))
+		}
+	}
+}
+
+// checkBinaries returns an error if an instruction of the function was not matched
+// with machine code from objdump, which happens if the dump was misaligned.
+func checkBinaries(function Function) error {
+	for _, line := range function.Lines {
+		if line.Assembly != "" && len(line.Binary) == 0 {
+			return fmt.Errorf("%v: no machine code found in the object dump for: %v", function.Name, line.Assembly)
+		}
+	}
+	return nil
+}
+
+// checkRedZone returns an error if an instruction of the function accesses the red zone
+// below the stack pointer, which Go does not reserve, e.g. if -mno-red-zone was overridden.
+func checkRedZone(function Function) error {
+	if redZoneAccess == nil {
+		return nil
+	}
+	for _, line := range function.Lines {
+		if redZoneAccess.MatchString(line.Assembly) {
+			return fmt.Errorf("%v: red zone access: %v", function.Name, line.Assembly)
+		}
+	}
+	return nil
+}
+
+// instructionClass is a class of instructions that cannot survive the translation,
+// e.g. calls to external symbols whose relocations are lost.
+type instructionClass struct {
+	Name    string
+	Pattern *regexp.Regexp
+}
+
+// checkInstructions returns an error if any instruction of the function belongs to
+// one of the unsafe instruction classes of the target architecture.
+func checkInstructions(function Function) error {
+	for _, line := range function.Lines {
+		for _, class := range unsafeInstructions {
+			if class.Pattern.MatchString(line.Assembly) {
+				return fmt.Errorf("%v: unsafe instruction (%v): %v", function.Name, class.Name, line.Assembly)
+			}
+		}
+	}
+	return nil
+}
+
+// stackAllocator matches instructions that allocate stack. The first submatch of the
+// pattern is the number of bytes, or empty if they are only known at run time, unless
+// the instructions always allocate Size bytes, e.g. push.
+type stackAllocator struct {
+	Pattern *regexp.Regexp
+	Size    int
+	// Shift is the left shift of the number of bytes, e.g. 12 for lsl #12 on arm64.
+	Shift int
+}
+
+// stackAllocation returns the bytes of stack that an instruction allocates, or -1
+// if they are only known at run time.
+func stackAllocation(asm string) int {
+	for _, allocator := range stackAllocators {
+		match := allocator.Pattern.FindStringSubmatch(asm)
+		if match == nil {
+			continue
+		} else if allocator.Size > 0 {
+			return allocator.Size
+		} else if match[1] == "" {
+			return -1
+		}
+		size, _ := strconv.Atoi(match[1])
+		return size << allocator.Shift
+	}
+	return 0
+}
+
+// addStackAllocation adds the stack that an instruction of a function allocates to the
+// stack size of the function, which stays -1 once it is only known at run time, e.g.
+// for variable-length arrays. Stack that is freed is not subtracted, so the stack
+// size is an upper bound.
+func addStackAllocation(stackSizes map[string]int, functionName, asm string) {
+	if size := stackAllocation(asm); size < 0 || stackSizes[functionName] < 0 {
+		stackSizes[functionName] = -1
+	} else {
+		stackSizes[functionName] += size
+	}
+}
+
+// nosplitStackLimit bounds the stack of functions marked NOSPLIT, which the linker
+// checks against the stack that the stack guard leaves them, about 800 bytes.
+const nosplitStackLimit = 256
+
+// isNosplit reports whether a function can skip the stack-growth prologue: it calls
+// no function, directly or through a register, and frameSize, the bytes of its
+// TEXT frame and of what it pushes before the C code, plus the stack of the C code
+// is small.
+func isNosplit(function Function, frameSize int) bool {
+	if function.StackSize < 0 || frameSize+function.StackSize > nosplitStackLimit {
+		return false
+	}
+	for _, line := range function.Lines {
+		for _, class := range unsafeInstructions {
+			if (class.Name == "call" || class.Name == "indirect branch") && class.Pattern.MatchString(line.Assembly) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// stackSmall is abi.StackSmall of the Go toolchain. The assembler marks leaf functions
+// whose frame is smaller NOSPLIT by itself, so they skip the stack-growth check.
+const stackSmall = 128
+
+// textFlags returns the flags of the TEXT directive of a function, followed by a
+// comma, or an empty string if it has none, and the stack that its frame reserves
+// for the C code. frameSize is the frame of the generated code and extra the bytes
+// that it puts below the stack pointer, e.g. the arguments passed on the stack. The
+// frame reserves extra and the stack of the C code, and the generated code moves the
+// stack pointer to the top of it before running the C code, so that the linker checks
+// the frames of NOSPLIT functions and the prologue of the others checks that the
+// stack fits. The frame of the others is at least stackSmall, since the assembler
+// would otherwise skip their prologue. The stack of the C code is not reserved if it
+// is only known at run time.
+func (t *TranslateUnit) textFlags(function Function, frameSize, extra int) (string, int) {
+	if t.AutoNosplit && isNosplit(function, frameSize+extra) {
+		return "NOSPLIT, ", function.StackSize + extra
+	}
+	reserved := max(function.StackSize, 0) + extra
+	if frameSize+reserved < stackSmall {
+		reserved = stackSmall - frameSize
+	}
+	return "", reserved
+}
+
+// identifier matches a Go identifier.
+var identifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
 var command = &cobra.Command{
 	Use:  "goat source [-o output_directory]",
 	Args: cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
+		config, _ := cmd.PersistentFlags().GetString("config")
+		if err := loadConfig(cmd.PersistentFlags(), config, args[0]); err != nil {
+			_, _ = fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
 		output, _ := cmd.PersistentFlags().GetString("output")
 		if output == "" {
 			var err error
@@ -393,23 +2010,186 @@ var command = &cobra.Command{
 		for _, m := range machineOptions {
 			options = append(options, "-m"+m)
 		}
+		if codeModel, _ := cmd.PersistentFlags().GetString("code-model"); codeModel != "" {
+			// the compiler checks the name, which differs between architectures
+			options = append(options, "-mcmodel="+codeModel)
+		}
 		extraOptions, _ := cmd.PersistentFlags().GetStringSlice("extra-option")
 		options = append(options, extraOptions...)
 		optimizeLevel, _ := cmd.PersistentFlags().GetInt("optimize-level")
 		options = append(options, fmt.Sprintf("-O%d", optimizeLevel))
 		file := NewTranslateUnit(args[0], output, options...)
-		if err := file.Translate(); err != nil {
+		file.IncludePaths, _ = cmd.PersistentFlags().GetStringSlice("include-path")
+		file.Defines, _ = cmd.PersistentFlags().GetStringSlice("define")
+		if goOutput, _ := cmd.PersistentFlags().GetString("go-out"); goOutput != "" {
+			file.Go = goOutput
+		}
+		if asmOutput, _ := cmd.PersistentFlags().GetString("asm-out"); asmOutput != "" {
+			file.GoAssembly = asmOutput
+		}
+		archSuffix, _ := cmd.PersistentFlags().GetBool("arch-suffix")
+		if file.StubArchs, _ = cmd.PersistentFlags().GetStringSlice("stub-arch"); len(file.StubArchs) > 0 {
+			if archSuffix {
+				_, _ = fmt.Fprintln(os.Stderr, "--arch-suffix and --stub-arch cannot be combined")
+				os.Exit(1)
+			}
+			if !slices.Contains(file.StubArchs, runtime.GOARCH) {
+				_, _ = fmt.Fprintf(os.Stderr, "--stub-arch must include the target architecture %v\n", runtime.GOARCH)
+				os.Exit(1)
+			}
+			// only the assembly is specific to the target architecture
+			file.GoAssembly = addArchSuffix(file.GoAssembly)
+		} else if archSuffix {
+			file.Go = addArchSuffix(file.Go)
+			file.GoAssembly = addArchSuffix(file.GoAssembly)
+		}
+		file.SymbolPrefix, _ = cmd.PersistentFlags().GetString("symbol-prefix")
+		if file.SymbolPrefix != "" && !identifier.MatchString(file.SymbolPrefix) {
+			_, _ = fmt.Fprintf(os.Stderr, "invalid symbol prefix %q\n", file.SymbolPrefix)
+			os.Exit(1)
+		}
+		file.ParseOnly, _ = cmd.PersistentFlags().GetBool("parse-only")
+		file.Out = cmd.OutOrStdout()
+		file.Append, _ = cmd.PersistentFlags().GetBool("append")
+		file.Slices, _ = cmd.PersistentFlags().GetBool("emit-slices")
+		file.Std, _ = cmd.PersistentFlags().GetString("std")
+		file.EmbedSource, _ = cmd.PersistentFlags().GetBool("embed-source")
+		noAutoNosplit, _ := cmd.PersistentFlags().GetBool("no-auto-nosplit")
+		file.AutoNosplit = !noAutoNosplit
+		file.VerboseAsm, _ = cmd.PersistentFlags().GetBool("verbose-asm")
+		file.VerifySelfContained, _ = cmd.PersistentFlags().GetBool("verify-selfcontained")
+		file.Strict, _ = cmd.PersistentFlags().GetBool("strict")
+		if file.Compiler, _ = cmd.PersistentFlags().GetString("compiler"); file.Compiler != "clang" && file.Compiler != "gcc" {
+			_, _ = fmt.Fprintf(os.Stderr, "unsupported compiler %q: must be clang or gcc\n", file.Compiler)
+			os.Exit(1)
+		}
+		file.Manifest, _ = cmd.PersistentFlags().GetString("manifest")
+		if tags, _ := cmd.PersistentFlags().GetString("build-tags"); tags != "" {
+			expr, err := constraint.Parse("//go:build " + tags)
+			if err != nil {
+				_, _ = fmt.Fprintf(os.Stderr, "invalid build tags %q: %v\n", tags, err)
+				os.Exit(1)
+			}
+			file.BuildTags = expr
+		}
+		if emitBenchmark, _ := cmd.PersistentFlags().GetBool("emit-bench"); emitBenchmark {
+			file.Benchmark = strings.TrimSuffix(file.Go, ".go") + "_bench_test.go"
+		}
+		var err error
+		if file.Package, err = outputPackage(file.Go, file.GoAssembly); err != nil {
+			_, _ = fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		ctx := cmd.Context()
+		if timeout, _ := cmd.PersistentFlags().GetDuration("timeout"); timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		if postProcess, _ := cmd.PersistentFlags().GetString("post-process"); strings.TrimSpace(postProcess) != "" {
+			file.AsmPostProcess = pipeCommand(ctx, postProcess)
+		}
+		if err := file.Translate(ctx); err != nil {
+			_, _ = fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	},
+}
+
+var listCommand = &cobra.Command{
+	Use:   "list",
+	Short: "List supported types and architectures",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		var types []string
+		for typeName := range supportedTypes {
+			// pointer results are listed with the pointers
+			if typeName != "void *" {
+				types = append(types, typeName)
+			}
+		}
+		sort.Strings(types)
+		out := cmd.OutOrStdout()
+		_, _ = fmt.Fprintln(out, "Types:")
+		for _, typeName := range types {
+			_, _ = fmt.Fprintf(out, "  %-20s %v\n", typeName, ParameterType{Type: typeName}.String())
+		}
+		_, _ = fmt.Fprintf(out, "  %-20s %v\n", "T *", ParameterType{Pointer: true}.String())
+		_, _ = fmt.Fprintln(out, "Vector types, used through pointers:")
+		for _, arch := range slices.Sorted(maps.Keys(vectorTypes)) {
+			_, _ = fmt.Fprintf(out, "  %-20s %v\n", arch, strings.Join(vectorTypes[arch], " "))
+		}
+		_, _ = fmt.Fprintln(out, "Architectures:")
+		_, _ = fmt.Fprintf(out, "  %-20s %v\n", runtime.GOARCH, buildTarget)
+	},
+}
+
+var checkCommand = &cobra.Command{
+	Use:   "check source",
+	Short: "Check that the functions of a source are translatable, without writing files",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		config, _ := cmd.Flags().GetString("config")
+		if err := loadConfig(cmd.Flags(), config, args[0]); err != nil {
 			_, _ = fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
 		}
+		file := NewTranslateUnit(args[0], "")
+		file.IncludePaths, _ = cmd.Flags().GetStringSlice("include-path")
+		file.Defines, _ = cmd.Flags().GetStringSlice("define")
+		file.Std, _ = cmd.Flags().GetString("std")
+		functions, err := file.parseSource()
+		if err != nil {
+			_, _ = fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		failed := false
+		out := cmd.OutOrStdout()
+		for _, function := range functions {
+			if err = file.validate([]Function{function}); err != nil {
+				_, _ = fmt.Fprintln(out, err)
+				failed = true
+			} else {
+				_, _ = fmt.Fprintf(out, "%v:%v: %v: ok\n", file.Source, function.Position, function.Name)
+			}
+		}
+		if failed {
+			os.Exit(1)
+		}
 	},
 }
 
 func init() {
-	command.PersistentFlags().StringP("output", "o", "", "output directory of generated files")
+	command.AddCommand(listCommand)
+	command.AddCommand(checkCommand)
+	command.PersistentFlags().String("config", "", "path of a JSON config file of default flags, "+configName+" next to the source if unset")
+	command.PersistentFlags().StringP("output", "o", "", "output directory of generated files, created if missing")
+	command.PersistentFlags().String("go-out", "", "path of the generated Go file, overriding the output directory")
+	command.PersistentFlags().String("asm-out", "", "path of the generated assembly file, overriding the output directory")
+	command.PersistentFlags().Bool("arch-suffix", false, "if set, append the target architecture to generated file names")
+	command.PersistentFlags().StringSlice("stub-arch", nil, "architectures sharing one Go stub, e.g. amd64,arm64, with the target architecture appended to the assembly file name")
+	command.PersistentFlags().Bool("emit-slices", false, "if set, generate wrappers taking slices instead of pointers to typed elements")
+	command.PersistentFlags().Bool("verbose-asm", false, "if set, comment each function of the generated assembly with its C signature and parameter registers")
+	command.PersistentFlags().Bool("embed-source", false, "if set, add the source and its SHA-256 to the headers of generated files")
+	command.PersistentFlags().Bool("emit-bench", false, "if set, generate a benchmark skeleton for each function")
+	command.PersistentFlags().String("symbol-prefix", "", "prefix of the Go names of the generated functions")
+	command.PersistentFlags().String("build-tags", "", "build constraint expression combined with the target architecture, e.g. 'simd && !purego'")
+	command.PersistentFlags().Bool("append", false, "if set, keep the functions of existing generated files that are not in the source")
+	command.PersistentFlags().String("post-process", "", "command, with space-separated arguments, that the generated assembly is piped through")
+	command.PersistentFlags().Bool("verify-selfcontained", false, "if set, fail unless the generated assembly only references its own symbols")
+	command.PersistentFlags().Bool("parse-only", false, "if set, only generate Go stubs and list the functions, without running clang and objdump")
+	command.PersistentFlags().String("manifest", "", "path of a JSON manifest describing the generated functions")
+	command.PersistentFlags().String("compiler", "clang", "C compiler, clang or gcc, which only compiles for the host")
+	command.PersistentFlags().Bool("no-auto-nosplit", false, "if set, keep the stack-growth prologue of leaf functions with small stacks")
+	command.PersistentFlags().String("std", "c11", "C standard of the parser and the compiler, e.g. c17 or gnu11")
 	command.PersistentFlags().StringSliceP("machine-option", "m", nil, "machine option for clang")
+	command.PersistentFlags().String("code-model", "", "code model passed to the compiler as -mcmodel, e.g. small, medium or large")
 	command.PersistentFlags().StringSliceP("extra-option", "e", nil, "extra option for clang")
+	command.PersistentFlags().StringSliceP("define", "D", nil, "macro defined for the C parser and clang, as NAME or NAME=VALUE")
+	command.PersistentFlags().StringSliceP("include-path", "I", nil, "include path for the C parser and clang")
+	command.PersistentFlags().Duration("timeout", 0, "if set, abort when clang and objdump take longer, e.g. 5m")
 	command.PersistentFlags().IntP("optimize-level", "O", 0, "optimization level for clang")
+	command.PersistentFlags().Bool("strict", false, "if set, fail on calls, indirect branches, PC-relative and thread-local references, absolute addresses, and arm64 atomics")
 	command.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "if set, increase verbosity level")
 }
 
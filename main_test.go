@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// unsafeClass returns the name of the first class of unsafe instructions that contains
+// the instruction, or an empty string if it is safe.
+func unsafeClass(asm string) string {
+	for _, class := range unsafeInstructions {
+		if class.Pattern.MatchString(asm) {
+			return class.Name
+		}
+	}
+	return ""
+}
+
+func TestSymbolLine(t *testing.T) {
+	for line, match := range map[string]bool{
+		"0000000000000000 <f>:":         true,
+		"0000000000000040 <mat_mul>:":   true,
+		"<f>:":                          true,
+		"<_f>:":                         true,
+		"f:":                            false,
+		"<f>":                           false,
+		"0: <f>:":                       false,
+		"Disassembly of section .text:": false,
+	} {
+		assert.Equal(t, match, symbolLine.MatchString(line), line)
+	}
+}
+
+func TestIsNop(t *testing.T) {
+	for asm, nop := range map[string]bool{
+		"nop":                                    true,
+		"nopw\t%cs:(%rax,%rax)":                  true,
+		"nopl\t0x0(%rax)":                        true,
+		"nopw\t0x0(%rax,%rax,1)":                 true,
+		"data16 cs nopw 0x0(%rax,%rax,1)":        true,
+		"data16 data16 cs nopw 0x0(%rax,%rax,1)": true,
+		"xchg\t%ax,%ax":                          true,
+		"xchg   %ax, %ax":                        true,
+		"hint\t#0":                               true,
+		"c.nop":                                  true,
+		"xchg\t%ax,%bx":                          false,
+		"xchgw\t%ax,(%rdi)":                      false,
+		"hint\t#34":                              false,
+		"data16":                                 false,
+		"cs":                                     false,
+		"":                                       false,
+		"ret":                                    false,
+		"nopsled":                                false,
+	} {
+		assert.Equal(t, nop, isNop(asm), asm)
+	}
+}
+
+func TestRunCommandCanceled(t *testing.T) {
+	if _, err := exec.LookPath("sleep"); err != nil {
+		t.Skip(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start := time.Now()
+	_, err := runCommand(ctx, "sleep", "10")
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Less(t, time.Since(start), 5*time.Second)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	_, err = runCommand(ctx, "sleep", "10")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.EqualError(t, err, "sleep: context deadline exceeded")
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestPostProcess(t *testing.T) {
+	for _, command := range []string{"cat", "tr", "false"} {
+		if _, err := exec.LookPath(command); err != nil {
+			t.Skip(err)
+		}
+	}
+	assembly := []byte("TEXT ·add(SB), $0-24\n\tRET\n")
+
+	translateUnit := TranslateUnit{GoAssembly: "add_amd64.s"}
+	processed, err := translateUnit.postProcess(assembly)
+	assert.NoError(t, err)
+	assert.Equal(t, assembly, processed)
+
+	translateUnit.AsmPostProcess = pipeCommand(context.Background(), "cat")
+	processed, err = translateUnit.postProcess(assembly)
+	assert.NoError(t, err)
+	assert.Equal(t, assembly, processed)
+
+	translateUnit.AsmPostProcess = pipeCommand(context.Background(), "tr a-z A-Z")
+	processed, err = translateUnit.postProcess(assembly)
+	assert.NoError(t, err)
+	assert.Equal(t, strings.ToUpper(string(assembly)), string(processed))
+
+	translateUnit.AsmPostProcess = pipeCommand(context.Background(), "false")
+	_, err = translateUnit.postProcess(assembly)
+	assert.EqualError(t, err, "failed to post-process add_amd64.s: false: exit status 1")
+
+	for _, command := range []string{"", "  \t"} {
+		translateUnit.AsmPostProcess = pipeCommand(context.Background(), command)
+		_, err = translateUnit.postProcess(assembly)
+		assert.EqualError(t, err, "failed to post-process add_amd64.s: empty post-processing command")
+	}
+}
+
+// fakeCommands puts scripts with the given names first in PATH. Each one prints a
+// version, or records its arguments, one per line, in <name>.run of the returned
+// directory and fails.
+func fakeCommands(t *testing.T, names ...string) string {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake commands are shell scripts")
+	}
+	bin := t.TempDir()
+	for _, name := range names {
+		script := "#!/bin/sh\nif [ \"$1\" = --version ]; then echo " + name + " 0.0; exit 0; fi\nprintf '%s\\n' \"$@\" > " + filepath.Join(bin, name+".run") + "\necho \"" + name + ": error\" >&2\nexit 1\n"
+		assert.NoError(t, os.WriteFile(filepath.Join(bin, name), []byte(script), 0755))
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return bin
+}
+
+// fakeArgs returns the arguments a fake command was last run with.
+func fakeArgs(t *testing.T, bin, name string) []string {
+	data, err := os.ReadFile(filepath.Join(bin, name+".run"))
+	assert.NoError(t, err)
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+func TestParseOnly(t *testing.T) {
+	bin, dir := fakeCommands(t, "clang", "objdump"), t.TempDir()
+	source := filepath.Join(dir, "add.c")
+	assert.NoError(t, os.WriteFile(source, []byte("long add(long a, long b) { return a + b; }\n\nvoid zero(float *x) { *x = 0; }\n"), 0644))
+	var out bytes.Buffer
+	translateUnit := NewTranslateUnit(source, filepath.Join(dir, "add"))
+	translateUnit.ParseOnly = true
+	translateUnit.Out = &out
+	assert.NoError(t, translateUnit.Translate(context.Background()))
+
+	assert.FileExists(t, filepath.Join(dir, "add", "add.go"))
+	assert.NoFileExists(t, filepath.Join(dir, "add", "add.s"))
+	assert.NoFileExists(t, filepath.Join(dir, "add.s"))
+	assert.NoFileExists(t, filepath.Join(bin, "clang.run"))
+	assert.NoFileExists(t, filepath.Join(bin, "objdump.run"))
+	assert.Equal(t, source+":1: add\n"+source+":3: zero\n", out.String())
+}
+
+func TestValidateBeforeCompile(t *testing.T) {
+	bin, dir := fakeCommands(t, "clang", "objdump"), t.TempDir()
+	source := filepath.Join(dir, "narrow.c")
+	assert.NoError(t, os.WriteFile(source, []byte("short narrow(long x) { return x; }\n"), 0644))
+	translateUnit := NewTranslateUnit(source, dir)
+	err := translateUnit.Translate(context.Background())
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), source+":1: error: narrow: unsupported return type: short")
+	}
+	assert.NoFileExists(t, filepath.Join(bin, "clang.run"))
+	assert.NoFileExists(t, filepath.Join(bin, "objdump.run"))
+	assert.NoFileExists(t, filepath.Join(dir, "narrow.go"))
+}
+
+func TestCompileError(t *testing.T) {
+	bin, dir := fakeCommands(t, "clang", "objdump"), t.TempDir()
+	source := filepath.Join(dir, "add.c")
+	assert.NoError(t, os.WriteFile(source, []byte("long add(long a, long b) { return a + b; }\n"), 0644))
+	translateUnit := NewTranslateUnit(source, dir)
+	err := translateUnit.Translate(context.Background())
+	if assert.Error(t, err) {
+		assert.True(t, strings.HasPrefix(err.Error(), "failed to compile "+source+": clang -S "), err.Error())
+		assert.Contains(t, err.Error(), "clang: error")
+	}
+	assert.Contains(t, fakeArgs(t, bin, "clang"), source)
+	assert.NoFileExists(t, filepath.Join(bin, "objdump.run"))
+}
+
+func TestIncludePaths(t *testing.T) {
+	bin, dir := fakeCommands(t, "clang", "objdump"), t.TempDir()
+	include, extra := filepath.Join(dir, "include"), filepath.Join(dir, "extra")
+	assert.NoError(t, os.Mkdir(include, 0755))
+	assert.NoError(t, os.Mkdir(extra, 0755))
+	source := filepath.Join(dir, "add.c")
+	assert.NoError(t, os.WriteFile(source, []byte("long add(long a, long b) { return a + b; }\n"), 0644))
+	translateUnit := NewTranslateUnit(source, dir)
+	translateUnit.IncludePaths = []string{include, extra}
+	assert.Error(t, translateUnit.Translate(context.Background()))
+	// the headers that the parser finds are found by clang as well, in the same order
+	args := fakeArgs(t, bin, "clang")
+	i, j := slices.Index(args, "-I"+include), slices.Index(args, "-I"+extra)
+	assert.True(t, i >= 0 && j > i, args)
+}
+
+func TestCompilerArgs(t *testing.T) {
+	// the C parser runs the host compiler, which gcc below would hide
+	host, err := exec.LookPath("cc")
+	if err != nil {
+		t.Skip("no host C compiler")
+	}
+	t.Setenv("CC", host)
+	bin, dir := fakeCommands(t, "clang", "gcc", "objdump"), t.TempDir()
+	source := filepath.Join(dir, "add.c")
+	assert.NoError(t, os.WriteFile(source, []byte("long add(long a, long b) { return a + b; }\n"), 0644))
+	for _, compiler := range []string{"clang", "gcc"} {
+		translateUnit := NewTranslateUnit(source, dir)
+		translateUnit.Compiler = compiler
+		assert.Error(t, translateUnit.Translate(context.Background()))
+		args := fakeArgs(t, bin, compiler)
+		if compiler == "clang" {
+			assert.True(t, len(args) > 5 && slices.Equal(args[:5], []string{"-S", "-target", buildTarget, "-c", source}), args)
+			assert.Contains(t, args, "-inline-threshold=1000")
+			assert.NotContains(t, args, "-finline-limit=1000")
+		} else {
+			// gcc only compiles for the host, and has no -mllvm options
+			assert.True(t, len(args) > 3 && slices.Equal(args[:3], []string{"-S", "-c", source}), args)
+			assert.Contains(t, args, "-finline-limit=1000")
+			assert.Contains(t, args, "-fno-stack-protector")
+			assert.NotContains(t, args, "-target")
+			assert.NotContains(t, args, "-mllvm")
+		}
+	}
+}
+
+func TestAppendSources(t *testing.T) {
+	dir := t.TempDir()
+	translate := func(source, code string) {
+		path := filepath.Join(dir, source)
+		assert.NoError(t, os.WriteFile(path, []byte(code), 0644))
+		translateUnit := NewTranslateUnit(path, dir)
+		translateUnit.Go = filepath.Join(dir, "stubs.go")
+		translateUnit.ParseOnly = true
+		translateUnit.Append = true
+		translateUnit.EmbedSource = true
+		translateUnit.Out = io.Discard
+		assert.NoError(t, translateUnit.Translate(context.Background()))
+	}
+	translate("a.c", "long a(long x) { return x; }\n")
+	translate("b.c", "long b(long x) { return x; }\n")
+	// regenerating a.c replaces its source, which moves after b.c
+	translate("a.c", "long a(long x) { return -x; }\n")
+
+	stub, err := os.ReadFile(filepath.Join(dir, "stubs.go"))
+	assert.NoError(t, err)
+	a, b := filepath.Join(dir, "a.c"), filepath.Join(dir, "b.c")
+	assert.Contains(t, string(stub), fmt.Sprintf("// source: %v\n// sha256: %x\n// source: %v\n// sha256: %x\n",
+		b, sha256.Sum256([]byte("long b(long x) { return x; }\n")),
+		a, sha256.Sum256([]byte("long a(long x) { return -x; }\n"))))
+	assert.Equal(t, 2, strings.Count(string(stub), "// source: "))
+	assert.Contains(t, string(stub), fmt.Sprintf("// source code of %v:\n//\n//\tlong b(long x) { return x; }\n", b))
+	assert.Contains(t, string(stub), fmt.Sprintf("// source code of %v:\n//\n//\tlong a(long x) { return -x; }\n", a))
+	assert.Equal(t, 2, strings.Count(string(stub), "// source code of "))
+	assert.Contains(t, string(stub), "\nfunc a(")
+	assert.Contains(t, string(stub), "\nfunc b(")
+}
+
+func TestCreateOutputDirectory(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "add.c")
+	assert.NoError(t, os.WriteFile(source, []byte("long add(long a, long b) { return a + b; }\n"), 0644))
+	output := filepath.Join(dir, "internal", "asm", "add")
+	translateUnit := NewTranslateUnit(source, output)
+	translateUnit.ParseOnly = true
+	translateUnit.Out = io.Discard
+	assert.NoError(t, translateUnit.Translate(context.Background()))
+	assert.DirExists(t, output)
+	assert.FileExists(t, filepath.Join(output, "add.go"))
+}
+
+func TestSplitObjectDumpLine(t *testing.T) {
+	for _, c := range []struct {
+		Line     string
+		Binary   []string
+		Assembly string
+	}{
+		{Line: "0:\t48 8d 04 37          \tlea    (%rdi,%rsi,1),%rax", Binary: []string{"48", "8d", "04", "37"}, Assembly: "lea    (%rdi,%rsi,1),%rax"},
+		{Line: "10:\t8b000020 \tadd\tx0, x1, x0", Binary: []string{"8b000020"}, Assembly: "add\tx0, x1, x0"},
+		{Line: "1c:\t00 00 00 00 ", Binary: []string{"00", "00", "00", "00"}, Assembly: ""},
+		// instructions without operands
+		{Line: "33:\tc3                   \tret", Binary: []string{"c3"}, Assembly: "ret"},
+		{Line: "34:\t90                   \tnop", Binary: []string{"90"}, Assembly: "nop"},
+		{Line: "1c:\td65f03c0 \tret", Binary: []string{"d65f03c0"}, Assembly: "ret"},
+		{Line: "4:\td503477f \tsmstart", Binary: []string{"d503477f"}, Assembly: "smstart"},
+		{Line: "8:\t8082                \tret", Binary: []string{"8082"}, Assembly: "ret"},
+		{Line: "c:\t4c000020 \tret", Binary: []string{"4c000020"}, Assembly: "ret"},
+	} {
+		binary, assembly := splitObjectDumpLine(c.Line)
+		assert.Equal(t, c.Binary, binary, c.Line)
+		assert.Equal(t, c.Assembly, assembly, c.Line)
+	}
+}
+
+func TestTextFlags(t *testing.T) {
+	translateUnit := TranslateUnit{AutoNosplit: true}
+	// a leaf function with a small stack is NOSPLIT, and its frame reserves its stack
+	flags, reserved := translateUnit.textFlags(Function{StackSize: 32}, 8, 16)
+	assert.Equal(t, "NOSPLIT, ", flags)
+	assert.Equal(t, 48, reserved)
+	// a larger stack is reserved in a frame that the prologue checks
+	flags, reserved = translateUnit.textFlags(Function{StackSize: 512}, 8, 16)
+	assert.Equal(t, "", flags)
+	assert.Equal(t, 528, reserved)
+	// which the assembler would skip below stackSmall
+	translateUnit.AutoNosplit = false
+	flags, reserved = translateUnit.textFlags(Function{StackSize: 32}, 8, 16)
+	assert.Equal(t, "", flags)
+	assert.Equal(t, stackSmall-8, reserved)
+	flags, reserved = translateUnit.textFlags(Function{StackSize: -1}, 8, 0)
+	assert.Equal(t, "", flags)
+	assert.Equal(t, stackSmall-8, reserved)
+}
+
+func TestListCommand(t *testing.T) {
+	var out bytes.Buffer
+	listCommand.SetOut(&out)
+	defer listCommand.SetOut(nil)
+	listCommand.Run(listCommand, nil)
+	for _, typeName := range []string{"int32_t", "float32x4_t", "__m256", "svfloat32_t", "vfloat32m1_t"} {
+		assert.Contains(t, out.String(), typeName)
+	}
+	for arch := range vectorTypes {
+		assert.Contains(t, out.String(), "\n  "+arch+" ")
+	}
+	assert.Contains(t, out.String(), "  int32_t              int32\n")
+	assert.Contains(t, out.String(), "  T *                  unsafe.Pointer\n")
+	assert.NotContains(t, out.String(), "void *")
+	assert.True(t, strings.HasSuffix(out.String(), "Architectures:\n  "+fmt.Sprintf("%-20s %v\n", runtime.GOARCH, buildTarget)))
+}
+
+func TestAddArchSuffix(t *testing.T) {
+	suffix := "_" + runtime.GOARCH
+	for path, expected := range map[string]string{
+		"add.s":                 "add" + suffix + ".s",
+		"kernels/add.go":        "kernels/add" + suffix + ".go",
+		"simd.v2.kernels.s":     "simd.v2.kernels" + suffix + ".s",
+		"internal.v1/kernels.s": "internal.v1/kernels" + suffix + ".s",
+		"kernels":               "kernels" + suffix,
+		"internal.v1/kernels":   "internal.v1/kernels" + suffix,
+	} {
+		assert.Equal(t, expected, addArchSuffix(path), path)
+	}
+}
+
+func TestOutputPackage(t *testing.T) {
+	dir := t.TempDir()
+	pkg, err := outputPackage(filepath.Join(dir, "simd", "kernels.go"), filepath.Join(dir, "simd", "kernels_amd64.s"))
+	assert.NoError(t, err)
+	assert.Equal(t, "simd", pkg)
+	// the stub and the assembly of another directory would be different packages
+	goPath, asmPath := filepath.Join(dir, "simd", "kernels.go"), filepath.Join(dir, "asm", "kernels_amd64.s")
+	_, err = outputPackage(goPath, asmPath)
+	assert.EqualError(t, err, goPath+" and "+asmPath+" must be in the same package directory")
+}
+
+func TestUnsupportedTypePosition(t *testing.T) {
+	source := filepath.Join(t.TempDir(), "widen.c")
+	code := "// the defines are parsed before the source\n\nlong add(long a, long b) { return a + b; }\n\nlong widen(short x)\n{\n    return x;\n}\n"
+	assert.NoError(t, os.WriteFile(source, []byte(code), 0644))
+	translateUnit := NewTranslateUnit(source, "")
+	translateUnit.Defines = []string{"ENABLE_SCALE", "SCALE=3", "BLOCK=64"}
+	functions, err := translateUnit.parseSource()
+	assert.NoError(t, err)
+	err = translateUnit.validate(functions)
+	if assert.Error(t, err) {
+		assert.True(t, strings.HasPrefix(err.Error(), source+":5: error: widen: unsupported type of parameter x: short"), err.Error())
+	}
+}
+
+func TestGenerateManifest(t *testing.T) {
+	dir := t.TempDir()
+	translateUnit := NewTranslateUnit(filepath.Join(dir, "add.c"), filepath.Join(dir, "add"))
+	translateUnit.Manifest = filepath.Join(dir, "manifest.json")
+	translateUnit.SymbolPrefix = "c_"
+	read := func() Manifest {
+		var manifest Manifest
+		data, err := os.ReadFile(translateUnit.Manifest)
+		assert.NoError(t, err)
+		assert.NoError(t, json.Unmarshal(data, &manifest))
+		return manifest
+	}
+	add := Function{Name: "add", Position: 1, Type: "long", FrameSize: 8, Parameters: []Parameter{
+		{Name: "a", ParameterType: ParameterType{Type: "long"}, Register: "A0"},
+		{Name: "b", ParameterType: ParameterType{Type: "long"}},
+	}}
+	zero := Function{Name: "zero", Position: 3, Type: "void", Parameters: []Parameter{
+		{Name: "x", ParameterType: ParameterType{Type: "float", Pointer: true}, Register: "A0"},
+	}}
+	assert.NoError(t, translateUnit.generateManifest([]Function{add, zero}))
+	assert.Equal(t, Manifest{
+		Source: translateUnit.Source,
+		Arch:   runtime.GOARCH,
+		Target: buildTarget,
+		Functions: []ManifestFunction{
+			{Name: "add", Symbol: "add.c_add", Line: 1, Type: "long", FrameSize: 8, Parameters: []ManifestParameter{
+				{Name: "a", Type: "long", GoType: "int64", Register: "A0"},
+				{Name: "b", Type: "long", GoType: "int64", Stack: true},
+			}},
+			{Name: "zero", Symbol: "add.c_zero", Line: 3, Type: "void", Parameters: []ManifestParameter{
+				{Name: "x", Type: "float *", GoType: "unsafe.Pointer", Register: "A0"},
+			}},
+		},
+	}, read())
+
+	// appending replaces the functions in place
+	translateUnit.Append = true
+	add.FrameSize = 16
+	assert.NoError(t, translateUnit.generateManifest([]Function{add}))
+	manifest := read()
+	if assert.Len(t, manifest.Functions, 2) {
+		assert.Equal(t, "add.c_add", manifest.Functions[0].Symbol)
+		assert.Equal(t, 16, manifest.Functions[0].FrameSize)
+		assert.Equal(t, "add.c_zero", manifest.Functions[1].Symbol)
+	}
+}
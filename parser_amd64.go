@@ -19,7 +19,6 @@ import (
 	"os"
 	"regexp"
 	"strings"
-	"unicode"
 
 	"github.com/klauspost/asmfmt"
 	"github.com/samber/lo"
@@ -32,15 +31,67 @@ const (
 
 var (
 	attributeLine = regexp.MustCompile(`^\s+\..+$`)
-	nameLine      = regexp.MustCompile(`^\w+:.+$`)
-	labelLine     = regexp.MustCompile(`^\.\w+_\d+:.*$`)
+	nameLine      = regexp.MustCompile(`^\w+:.*$`)
+	labelLine     = regexp.MustCompile(`^\.(\w+_\d+|L\d+):.*$`)
 	codeLine      = regexp.MustCompile(`^\s+\w+.+$`)
+	retLine       = regexp.MustCompile(`^retq?$`)
 
-	symbolLine = regexp.MustCompile(`^\w+\s+<\w+>:$`)
+	// GOT and TLS relocations of global and thread-local variables
+	externalReference = regexp.MustCompile(`(?i)@(gotpcrel|gotoff|gottpoff|got|ntpoff|tpoff|dtpoff|tlsgd|tlsld|tlsdesc)\b|%fs:`)
+
+	// objdump is forced to AT&T syntax, which the parser expects, whatever the user configured
+	objdumpOptions = []string{"-M", "att"}
+
+	// accesses below the stack pointer, in the red zone that -mno-red-zone forbids
+	redZoneAccess = regexp.MustCompile(`-(0x[0-9a-f]+|\d+)\(%rsp\)`)
+
+	symbolLine = regexp.MustCompile(`^(\w+\s+)?<\w+>:$`)
 	dataLine   = regexp.MustCompile(`^\w+:\s+\w+\s+.+$`)
+	// bytes of a long instruction that objdump wrapped onto another line, with or without an address
+	bytesLine = regexp.MustCompile(`^(\w+:\s+)?([0-9a-f]{2}\s+)*[0-9a-f]{2}$`)
 
 	registers    = []string{"DI", "SI", "DX", "CX", "R8", "R9"}
 	xmmRegisters = []string{"X0", "X1", "X2", "X3", "X4", "X5", "X6", "X7"}
+
+	// register names, which the Go assembler does not accept as argument names
+	registerName = regexp.MustCompile(`^([A-D][XLH]|[SD]IB?|[SB]PB?|R\d+B?|[XYZ]\d+|[KFM][0-7]|[C-GS]S|[CDT]R\d+|TLS|[GIL]DTR|MSW|TASK)$`)
+
+	// extending loads of parameters narrower than 8 bytes, float included, whose bits
+	// are loaded when it is passed on the stack
+	narrowLoads = map[string]string{
+		"int":           "MOVL",
+		"int32_t":       "MOVL",
+		"uint32_t":      "MOVL",
+		"char":          "MOVBQSX",
+		"signed char":   "MOVBQSX",
+		"unsigned char": "MOVBQZX",
+		"_Bool":         "MOVBQZX",
+		"float":         "MOVL",
+	}
+
+	// stores of results from their registers, keyed by size for integers and pointers and
+	// by type for floating-point numbers, of which float _Complex is packed in one register
+	integerStores = map[int]string{1: "MOVB", 4: "MOVL", 8: "MOVQ"}
+	floatStores   = map[string]string{"float": "MOVSS", "double": "MOVSD", "float _Complex": "MOVSD"}
+
+	// the function called by an instruction
+	callTarget = regexp.MustCompile(`^callq?\s+(\w+)`)
+
+	// instructions that allocate stack, with a register operand if the size is only known at
+	// run time, of which realignments skip at most the alignment
+	stackAllocators = []stackAllocator{
+		{Pattern: regexp.MustCompile(`^subq\s+(?:\$(\d+)|%\w+),\s*%rsp$`)},
+		{Pattern: regexp.MustCompile(`^andq\s+\$-(\d+),\s*%rsp$`)},
+		{Pattern: regexp.MustCompile(`^push`), Size: 8},
+	}
+
+	unsafeInstructions = []instructionClass{
+		{Name: "call", Pattern: regexp.MustCompile(`^call`)},
+		{Name: "indirect branch", Pattern: regexp.MustCompile(`^jmp\w*\s+\*`)},
+		{Name: "PC-relative reference", Pattern: regexp.MustCompile(`\(%rip\)`)},
+		{Name: "absolute address", Pattern: regexp.MustCompile(`\$[A-Za-z_.]`)},
+		{Name: "thread-local reference", Pattern: regexp.MustCompile(`%fs:`)},
+	}
 )
 
 type Line struct {
@@ -126,6 +177,14 @@ func parseAssembly(path string) (map[string][]Line, map[string]int, error) {
 			}
 		} else if codeLine.MatchString(line) {
 			asm := sanitizeAsm(line)
+			if err := checkExternalReference(functionName, asm); err != nil {
+				return nil, nil, err
+			}
+			addStackAllocation(stackSizes, functionName, asm)
+			if isNop(asm) {
+				// nops are skipped in the object dump as padding, and labels move to the next instruction
+				continue
+			}
 			if labelName == "" {
 				functions[functionName] = append(functions[functionName], Line{Assembly: asm})
 			} else {
@@ -159,44 +218,45 @@ func parseObjectDump(dump string, functions map[string][]Line) error {
 	var (
 		functionName string
 		lineNumber   int
+		skipped      bool
 	)
 	for i, line := range strings.Split(dump, "\n") {
 		line = strings.TrimSpace(line)
 		if symbolLine.MatchString(line) {
 			functionName = strings.Split(line, "<")[1]
 			functionName = strings.Split(functionName, ">")[0]
-			lineNumber = 0
-		} else if dataLine.MatchString(line) {
-			data := strings.Split(line, ":")[1]
-			data = strings.TrimSpace(data)
-			splits := strings.Split(data, " ")
-			var (
-				binary   []string
-				assembly string
-			)
-			for i, s := range splits {
-				if s == "" || unicode.IsSpace(rune(s[0])) {
-					assembly = strings.Join(splits[i:], " ")
-					assembly = strings.TrimSpace(assembly)
-					break
+			lineNumber, skipped = 0, false
+		} else if bytesLine.MatchString(line) || dataLine.MatchString(line) {
+			var binary []string
+			var assembly string
+			if bytesLine.MatchString(line) {
+				_, data, ok := strings.Cut(line, ":")
+				if !ok {
+					data = line
 				}
-				binary = append(binary, s)
+				binary = strings.Fields(data)
+			} else {
+				binary, assembly = splitObjectDumpLine(line)
 			}
 
 			assembly = sanitizeAsm(assembly)
-			if strings.Contains(assembly, "nop") {
+			if assembly == "" {
+				// the rest of the bytes of the previous instruction
+				if skipped {
+					continue
+				}
+				if lineNumber == 0 {
+					return fmt.Errorf("%d: unexpected objectdump line: %s", i+1, line)
+				}
+				previous := &functions[functionName][lineNumber-1]
+				previous.Binary = append(previous.Binary, binary...)
 				continue
 			}
-
-			if assembly == "" {
-				return fmt.Errorf("try to increase --insn-width of objdump")
-			} else if strings.HasPrefix(assembly, "nop") ||
-				assembly == "xchg   %ax,%ax" ||
-				assembly == "cs nopw 0x0(%rax,%rax,1)" {
+			if skipped = isNop(assembly); skipped {
 				continue
 			}
 			if lineNumber >= len(functions[functionName]) {
-				return fmt.Errorf("%d: unexpected objectdump line: %s", i, line)
+				return fmt.Errorf("%d: unexpected objectdump line: %s", i+1, line)
 			}
 			functions[functionName][lineNumber].Binary = binary
 			lineNumber++
@@ -208,41 +268,67 @@ func parseObjectDump(dump string, functions map[string][]Line) error {
 func (t *TranslateUnit) generateGoAssembly(path string, functions []Function) error {
 	// generate code
 	var builder strings.Builder
-	builder.WriteString(buildTags)
+	builder.WriteString(t.buildConstraint())
 	t.writeHeader(&builder)
-	for _, function := range functions {
+	if t.AutoNosplit {
+		builder.WriteString("#include \"textflag.h\"\n\n")
+	}
+	for _, function := range lo.ToSlicePtr(functions) {
 		returnSize := 0
 		if function.Type != "void" {
 			returnSize += 8
 		}
-		builder.WriteString(fmt.Sprintf("\nTEXT ·%v(SB), $%d-%d\n",
-			function.Name, returnSize, len(function.Parameters)*8))
 		registerIndex, xmmRegisterIndex, offset := 0, 0, 0
 		var stack []lo.Tuple2[int, Parameter]
-		for _, param := range function.Parameters {
+		var argsBuilder strings.Builder
+		for i, param := range function.Parameters {
 			sz := 8
 			if param.Pointer {
 				sz = 8
 			} else {
 				sz = supportedTypes[param.Type]
 			}
-			if offset%sz != 0 {
-				offset += sz - offset%sz
+			if align := param.Align(); offset%align != 0 {
+				offset += align - offset%align
 			}
-			if !param.Pointer && (param.Type == "double" || param.Type == "float") {
+			if part, ok := complexTypes[param.Type]; ok && !param.Pointer {
+				// float _Complex is packed in one register, double _Complex is split in two
+				if part == "float" {
+					if xmmRegisterIndex+1 > len(xmmRegisters) {
+						return fmt.Errorf("%v: complex parameter %v does not fit in registers", function.Name, param.Name)
+					}
+					argsBuilder.WriteString(fmt.Sprintf("\tMOVSD %s+%d(FP), %s\n", param.Name, offset, xmmRegisters[xmmRegisterIndex]))
+					function.Parameters[i].Register = xmmRegisters[xmmRegisterIndex]
+					xmmRegisterIndex++
+				} else {
+					if xmmRegisterIndex+2 > len(xmmRegisters) {
+						return fmt.Errorf("%v: complex parameter %v does not fit in registers", function.Name, param.Name)
+					}
+					argsBuilder.WriteString(fmt.Sprintf("\tMOVSD %s_real+%d(FP), %s\n", param.Name, offset, xmmRegisters[xmmRegisterIndex]))
+					argsBuilder.WriteString(fmt.Sprintf("\tMOVSD %s_imag+%d(FP), %s\n", param.Name, offset+8, xmmRegisters[xmmRegisterIndex+1]))
+					function.Parameters[i].Register = xmmRegisters[xmmRegisterIndex] + ", " + xmmRegisters[xmmRegisterIndex+1]
+					xmmRegisterIndex += 2
+				}
+			} else if !param.Pointer && (param.Type == "double" || param.Type == "float") {
 				if xmmRegisterIndex < len(xmmRegisters) {
 					if param.Type == "double" {
-						builder.WriteString(fmt.Sprintf("\tMOVSD %s+%d(FP), %s\n", param.Name, offset, xmmRegisters[xmmRegisterIndex]))
+						argsBuilder.WriteString(fmt.Sprintf("\tMOVSD %s+%d(FP), %s\n", param.Name, offset, xmmRegisters[xmmRegisterIndex]))
 					} else {
-						builder.WriteString(fmt.Sprintf("\tMOVSS %s+%d(FP), %s\n", param.Name, offset, xmmRegisters[xmmRegisterIndex]))
+						argsBuilder.WriteString(fmt.Sprintf("\tMOVSS %s+%d(FP), %s\n", param.Name, offset, xmmRegisters[xmmRegisterIndex]))
 					}
+					function.Parameters[i].Register = xmmRegisters[xmmRegisterIndex]
 					xmmRegisterIndex++
 				} else {
 					stack = append(stack, lo.Tuple2[int, Parameter]{A: offset, B: param})
 				}
 			} else {
 				if registerIndex < len(registers) {
-					builder.WriteString(fmt.Sprintf("\tMOVQ %s+%d(FP), %s\n", param.Name, offset, registers[registerIndex]))
+					if instruction, ok := narrowLoads[param.Type]; ok && !param.Pointer {
+						argsBuilder.WriteString(fmt.Sprintf("\t%s %s+%d(FP), %s\n", instruction, param.Name, offset, registers[registerIndex]))
+					} else {
+						argsBuilder.WriteString(fmt.Sprintf("\tMOVQ %s+%d(FP), %s\n", param.Name, offset, registers[registerIndex]))
+					}
+					function.Parameters[i].Register = registers[registerIndex]
 					registerIndex++
 				} else {
 					stack = append(stack, lo.Tuple2[int, Parameter]{A: offset, B: param})
@@ -253,43 +339,84 @@ func (t *TranslateUnit) generateGoAssembly(path string, functions []Function) er
 		if offset%8 != 0 {
 			offset += 8 - offset%8
 		}
+		// the results follow the arguments, aligned to 8 bytes
+		pushed := 0
+		if len(stack) > 0 {
+			pushed = (len(stack) + 1) * 8
+		}
+		flags, reserved := t.textFlags(*function, returnSize, pushed)
+		function.FrameSize = returnSize + reserved
+		builder.WriteRune('\n')
+		if t.VerboseAsm {
+			writeFunctionComment(&builder, *function)
+		}
+		builder.WriteString(fmt.Sprintf("TEXT ·%v(SB), %s$%d-%d\n",
+			function.Name, flags, function.FrameSize, offset+function.ResultSize()))
+		builder.WriteString(argsBuilder.String())
+		if reserved > 0 {
+			// the pushed arguments and the C code use the stack that the frame reserves
+			builder.WriteString(fmt.Sprintf("\tADJSP $-%d\n", reserved))
+		}
 		if len(stack) > 0 {
 			for i := len(stack) - 1; i >= 0; i-- {
-				builder.WriteString(fmt.Sprintf("\tPUSHQ %s+%d(FP)\n", stack[i].B.Name, stack[i].A))
+				// each argument takes an 8-byte slot, into which narrower ones are extended
+				if instruction, ok := narrowLoads[stack[i].B.Type]; ok && !stack[i].B.Pointer {
+					builder.WriteString(fmt.Sprintf("\t%s %s+%d(FP), AX\n", instruction, stack[i].B.Name, stack[i].A))
+					builder.WriteString("\tPUSHQ AX\n")
+				} else {
+					builder.WriteString(fmt.Sprintf("\tPUSHQ %s+%d(FP)\n", stack[i].B.Name, stack[i].A))
+				}
 			}
 			builder.WriteString("\tPUSHQ $0\n")
 		}
-		for _, line := range function.Lines {
+		var epilogue strings.Builder
+		if len(stack) > 0 {
+			for i := 0; i <= len(stack); i++ {
+				epilogue.WriteString("\tPOPQ DI\n")
+			}
+		}
+		if reserved > 0 {
+			epilogue.WriteString(fmt.Sprintf("\tADJSP $%d\n", reserved))
+		}
+		if len(function.Results) > 0 {
+			writeStructResult(&epilogue, *function, offset)
+		} else if function.Type != "void" {
+			writeResult(&epilogue, *function, offset, "AX", xmmRegisters)
+		}
+		epilogue.WriteString("\tRET\n")
+		// the assembler follows the stack pointer in the order of the code, not of its
+		// branches, so a stack that was moved is restored once, after the last line
+		shared := len(stack) > 0 || reserved > 0
+		jumped := false
+		for i, line := range function.Lines {
 			for _, label := range line.Labels {
 				builder.WriteString(label)
 				builder.WriteString(":\n")
 			}
-			if line.Assembly == "retq" {
-				if len(stack) > 0 {
-					for i := 0; i <= len(stack); i++ {
-						builder.WriteString("\tPOPQ DI\n")
-					}
-				}
-				if function.Type != "void" {
-					switch function.Type {
-					case "int64_t", "long", "_Bool":
-						builder.WriteString(fmt.Sprintf("\tMOVQ AX, result+%d(FP)\n", offset))
-					case "double":
-						builder.WriteString(fmt.Sprintf("\tMOVSD X0, result+%d(FP)\n", offset))
-					case "float":
-						builder.WriteString(fmt.Sprintf("\tMOVSS X0, result+%d(FP)\n", offset))
-					default:
-						return fmt.Errorf("unsupported return type: %v", function.Type)
-					}
-				}
-				builder.WriteString("\tRET\n")
-			} else {
+			if !retLine.MatchString(line.Assembly) {
 				builder.WriteString(line.String())
+			} else if shared && i < len(function.Lines)-1 {
+				builder.WriteString("\tJMP epilogue\n")
+				jumped = true
+			} else {
+				if jumped {
+					builder.WriteString("epilogue:\n")
+					jumped = false
+				}
+				builder.WriteString(epilogue.String())
 			}
 		}
+		if jumped {
+			builder.WriteString("epilogue:\n")
+			builder.WriteString(epilogue.String())
+		}
 	}
 
 	// write file
+	content, err := t.appendGenerated(path, builder.String())
+	if err != nil {
+		return err
+	}
 	f, err := os.Create(path)
 	if err != nil {
 		return err
@@ -300,10 +427,57 @@ func (t *TranslateUnit) generateGoAssembly(path string, functions []Function) er
 			os.Exit(1)
 		}
 	}(f)
-	bytes, err := asmfmt.Format(strings.NewReader(builder.String()))
+	bytes, err := asmfmt.Format(strings.NewReader(content))
 	if err != nil {
 		return err
 	}
+	if bytes, err = t.postProcess(bytes); err != nil {
+		return err
+	}
+	if t.VerifySelfContained {
+		if err = t.verifySelfContained(bytes); err != nil {
+			return err
+		}
+	}
 	_, err = f.Write(bytes)
 	return err
 }
+
+// writeStructResult stores the fields of a struct result of at most 16 bytes, of which
+// each eightbyte is returned in X0 and then X1 if it only holds floats, or else in AX
+// and then DX.
+func writeStructResult(builder *strings.Builder, function Function, offset int) {
+	offsets := function.ResultOffsets()
+	intRegisters, sseRegisters := []string{"AX", "DX"}, []string{"X0", "X1"}
+	for eightbyte := 0; eightbyte*8 < function.ResultSize(); eightbyte++ {
+		fields := lo.Filter(lo.Range(len(function.Results)), func(i int, _ int) bool {
+			return offsets[i]/8 == eightbyte
+		})
+		sse := lo.EveryBy(fields, func(i int) bool {
+			return function.Results[i].Type == "float" || function.Results[i].Type == "double"
+		})
+		var register string
+		if sse {
+			register, sseRegisters = sseRegisters[0], sseRegisters[1:]
+		} else {
+			register, intRegisters = intRegisters[0], intRegisters[1:]
+		}
+		shift := 0
+		for _, i := range fields {
+			result := function.Results[i]
+			if rest := offsets[i] % 8; rest > shift {
+				if sse {
+					builder.WriteString(fmt.Sprintf("\tPSRLQ $%d, %s\n", (rest-shift)*8, register))
+				} else {
+					builder.WriteString(fmt.Sprintf("\tSHRQ $%d, %s\n", (rest-shift)*8, register))
+				}
+				shift = rest
+			}
+			store := integerStores[supportedTypes[result.Type]]
+			if sse {
+				store = floatStores[result.Type]
+			}
+			builder.WriteString(fmt.Sprintf("\t%s %s, %s+%d(FP)\n", store, register, result.Name, offset+offsets[i]))
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckRedZone(t *testing.T) {
+	for _, c := range []struct {
+		Assembly string
+		Access   bool
+	}{
+		{Assembly: "movq\t%rdi, -0x8(%rsp)", Access: true},
+		{Assembly: "movq\t%rdi, -8(%rsp)", Access: true},
+		{Assembly: "movl\t-0x14(%rsp), %eax", Access: true},
+		{Assembly: "movq\t%rdi, 8(%rsp)", Access: false},
+		{Assembly: "movq\t%rdi, 0x8(%rsp)", Access: false},
+		{Assembly: "movq\t%rdi, (%rsp)", Access: false},
+		{Assembly: "movq\t%rdi, -8(%rbp)", Access: false},
+	} {
+		err := checkRedZone(Function{Name: "pick", Lines: []Line{{Assembly: c.Assembly}}})
+		if c.Access {
+			assert.EqualError(t, err, "pick: red zone access: "+c.Assembly)
+		} else {
+			assert.NoError(t, err, c.Assembly)
+		}
+	}
+}
+
+func TestBytesLine(t *testing.T) {
+	for line, match := range map[string]bool{
+		"7:\t33 22 11":     true,
+		"1c:\t00 00 00 00": true,
+		"2e:\t00":          true,
+		"33 22 11":         true,
+		"0:\t48 b8 88 77 66 55 44 \tmovabs $0x1122334455667788,%rax": false,
+		"33:\tc3                   \tret":                            false,
+		"2f:\t48 83 c0 01          \tadd    $0x1,%rax":               false,
+		"0000000000000000 <f>:":                                      false,
+	} {
+		assert.Equal(t, match, bytesLine.MatchString(line), line)
+	}
+}
+
+func TestParseObjectDumpWrappedBytes(t *testing.T) {
+	// objdump -d -M att of long instructions, which are wrapped after 7 bytes
+	dump := strings.Join([]string{
+		"0000000000000000 <f>:",
+		"   0:\t48 b8 88 77 66 55 44 \tmovabs $0x1122334455667788,%rax",
+		"   7:\t33 22 11 ",
+		"   a:\t62 f2 7d 49 58 8c 98 \tvpbroadcastd 0x12345678(%rax,%rbx,4),%zmm1{%k1}",
+		"  11:\t78 56 34 12 ",
+		"  15:\t66 66 2e 0f 1f 84 00 \tdata16 cs nopw 0x0(%rax,%rax,1)",
+		"  1c:\t00 00 00 00 ",
+		"  20:\t66 66 66 66 66 66 2e \tdata16 data16 data16 data16 data16 cs nopw 0x0(%rax,%rax,1)",
+		"  27:\t0f 1f 84 00 00 00 00 ",
+		"  2e:\t00 ",
+		"  2f:\t48 83 c0 01          \tadd    $0x1,%rax",
+		"  33:\tc3                   \tret",
+	}, "\n")
+	functions := map[string][]Line{"f": {
+		{Assembly: "movabsq\t$1234605616436508552, %rax"},
+		{Assembly: "vpbroadcastd\t305419896(%rax,%rbx,4), %zmm1 {%k1}"},
+		{Assembly: "addq\t$1, %rax"},
+		{Assembly: "retq"},
+	}}
+	assert.NoError(t, parseObjectDump(dump, functions))
+	assert.Equal(t, [][]string{
+		{"48", "b8", "88", "77", "66", "55", "44", "33", "22", "11"},
+		{"62", "f2", "7d", "49", "58", "8c", "98", "78", "56", "34", "12"},
+		{"48", "83", "c0", "01"},
+		{"c3"},
+	}, lo.Map(functions["f"], func(line Line, _ int) []string { return line.Binary }))
+}
+
+func TestCheckBinaries(t *testing.T) {
+	// the dump ended before the last instruction, e.g. if it skipped an instruction as padding
+	function := Function{Name: "sum_squares", Lines: []Line{
+		{Assembly: "imul x", Binary: []string{"0f", "af"}},
+		{Labels: []string{"LBB0_1"}},
+		{Assembly: "ret"},
+	}}
+	assert.EqualError(t, checkBinaries(function), "sum_squares: no machine code found in the object dump for: ret")
+	function.Lines[2].Binary = []string{"c3"}
+	assert.NoError(t, checkBinaries(function))
+}
+
+func TestObjdumpArguments(t *testing.T) {
+	// the dump is parsed in AT&T syntax, whatever the default of objdump is
+	translateUnit := TranslateUnit{Object: "add.o"}
+	assert.Equal(t, []string{"-d", "add.o", "--insn-width", "16", "-M", "att"}, translateUnit.objdumpArguments())
+}
+
+func TestUnsafeInstructions(t *testing.T) {
+	for asm, class := range map[string]string{
+		"movabsq\t$.LCPI0_0, %rax":     "absolute address",
+		"movl\t$pool, %eax":            "absolute address",
+		"movq\t$_table+8, %rcx":        "absolute address",
+		"movq\t$1, %rax":               "",
+		"addq\t$-8, %rsp":              "",
+		"movl\t$0x10, %eax":            "",
+		"movsd\t.LCPI0_0(%rip), %xmm0": "PC-relative reference",
+		"callq\tsqrt":                  "call",
+	} {
+		assert.Equal(t, class, unsafeClass(asm), asm)
+	}
+}
+
+func TestParseObjectDumpLineNumber(t *testing.T) {
+	dump := strings.Join([]string{
+		"",
+		"0000000000000000 <add>:",
+		"   0:\t48 8d 04 37          \tlea    (%rdi,%rsi,1),%rax",
+		"   4:\tc3                   \tret",
+		"   5:\tcc                   \tint3",
+	}, "\n")
+	functions := map[string][]Line{"add": {{Assembly: "leaq\t(%rdi,%rsi), %rax"}, {Assembly: "retq"}}}
+	// the line of the dump is counted from 1
+	assert.EqualError(t, parseObjectDump(dump, functions), "5: unexpected objectdump line: 5:\tcc                   \tint3")
+}
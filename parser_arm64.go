@@ -32,16 +32,69 @@ const (
 
 var (
 	attributeLine = regexp.MustCompile(`^\s+\..+$`)
-	nameLine      = regexp.MustCompile(`^\w+:.+$`)
-	labelLine     = regexp.MustCompile(`^\.\w+_\d+:.*$`)
+	nameLine      = regexp.MustCompile(`^\w+:.*$`)
+	labelLine     = regexp.MustCompile(`^\.(\w+_\d+|L\d+):.*$`)
 	codeLine      = regexp.MustCompile(`^\s+\w+.+$`)
-	jmpLine       = regexp.MustCompile(`^(b|b\.\w{2})\t\.\w+_\d+$`)
+	retLine       = regexp.MustCompile(`^ret$`)
+	jmpLine       = regexp.MustCompile(`^(b|b\.\w{2})\t\.(\w+_\d+|L\d+)$`)
+	// indirect branches jump to addresses computed from code labels, which are moved by the translation
+	indirectJmpLine = regexp.MustCompile(`^(br|blr|bra[ab]z?|blra[ab]z?)\s`)
 
-	symbolLine = regexp.MustCompile(`^\w+\s+<\w+>:$`)
+	// GOT and TLS relocations of global and thread-local variables
+	externalReference = regexp.MustCompile(`:(got|got_lo12|gottprel\w*|tprel\w*|dtprel\w*|tlsdesc\w*):|@(GOTPAGE|GOTPAGEOFF|TLVPPAGE|TLVPPAGEOFF)\b`)
+
+	// extra options of objdump
+	objdumpOptions []string
+
+	// accesses below the stack pointer, which is safe without a red zone
+	redZoneAccess *regexp.Regexp
+
+	symbolLine = regexp.MustCompile(`^(\w+\s+)?<\w+>:$`)
 	dataLine   = regexp.MustCompile(`^\w+:\s+\w+\s+.+$`)
 
 	registers   = []string{"R0", "R1", "R2", "R3", "R4", "R5", "R6", "R7"}
 	fpRegisters = []string{"F0", "F1", "F2", "F3", "F4", "F5", "F6", "F7"}
+
+	// register names, which the Go assembler does not accept as argument names
+	registerName = regexp.MustCompile(`^(RSP|ZR|LR|[RFVZP]\d+)$`)
+
+	// extending loads of parameters narrower than 8 bytes, char is unsigned on arm64,
+	// and float is loaded as its bits when it is passed on the stack
+	narrowLoads = map[string]string{
+		"int":           "MOVW",
+		"int32_t":       "MOVW",
+		"uint32_t":      "MOVWU",
+		"char":          "MOVBU",
+		"signed char":   "MOVB",
+		"unsigned char": "MOVBU",
+		"_Bool":         "MOVBU",
+		"float":         "MOVWU",
+	}
+
+	// stores of results from their registers, keyed by size for integers and pointers and
+	// by type for floating-point numbers
+	integerStores = map[int]string{1: "MOVB", 4: "MOVW", 8: "MOVD"}
+	floatStores   = map[string]string{"float": "FMOVS", "double": "FMOVD"}
+
+	// the function called by an instruction
+	callTarget = regexp.MustCompile(`^bl\s+(\w+)`)
+
+	// instructions that allocate stack, with a register operand if the size is only known at run time
+	stackAllocators = []stackAllocator{
+		{Pattern: regexp.MustCompile(`^sub\s+sp,\s*sp,\s*#(\d+),\s*lsl\s+#12`), Shift: 12},
+		{Pattern: regexp.MustCompile(`^sub\s+sp,\s*sp,\s*(?:#(\d+)|\w+)`)},
+		{Pattern: regexp.MustCompile(`\[sp,\s*#-(\d+)\]!$`)},
+	}
+
+	unsafeInstructions = []instructionClass{
+		{Name: "call", Pattern: regexp.MustCompile(`^bl\s`)},
+		{Name: "indirect branch", Pattern: indirectJmpLine},
+		{Name: "PC-relative reference", Pattern: regexp.MustCompile(`^adrp?\s`)},
+		{Name: "absolute address", Pattern: regexp.MustCompile(`:abs_g[0-3]`)},
+		{Name: "thread-local reference", Pattern: regexp.MustCompile(`tpidr_el0`)},
+		// atomics of LSE and exclusive accesses, which Go does not order with its own memory accesses
+		{Name: "atomic", Pattern: regexp.MustCompile(`^(cas|casp|swp|ld(add|clr|eor|set|smax|smin|umax|umin)|st(add|clr|eor|set|smax|smin|umax|umin))(a|al|l)?[bh]?\s|^(ld|st)a?x(r[bh]?|p)\s|^stlx(r[bh]?|p)\s`)},
+	}
 )
 
 type Line struct {
@@ -110,6 +163,17 @@ func parseAssembly(path string) (map[string][]Line, map[string]int, error) {
 		} else if codeLine.MatchString(line) {
 			asm := strings.Split(line, "//")[0]
 			asm = strings.TrimSpace(asm)
+			if err := checkExternalReference(functionName, asm); err != nil {
+				return nil, nil, err
+			}
+			addStackAllocation(stackSizes, functionName, asm)
+			if isNop(asm) {
+				// nops are skipped in the object dump as padding, and labels move to the next instruction
+				continue
+			}
+			if indirectJmpLine.MatchString(asm) {
+				return nil, nil, fmt.Errorf("%v: unsupported indirect branch: %v", functionName, asm)
+			}
 			if labelName == "" {
 				functions[functionName] = append(functions[functionName], Line{Assembly: asm})
 			} else {
@@ -140,23 +204,13 @@ func parseObjectDump(dump string, functions map[string][]Line) error {
 			functionName = strings.Split(functionName, ">")[0]
 			lineNumber = 0
 		} else if dataLine.MatchString(line) {
-			data := strings.Split(line, ":")[1]
-			data = strings.TrimSpace(data)
-			splits := strings.Split(data, " ")
-			var (
-				binary   string
-				assembly string
-			)
-			for i, s := range splits {
-				if s == "" || unicode.IsSpace(rune(s[0])) {
-					assembly = strings.Join(splits[i:], " ")
-					assembly = strings.TrimSpace(assembly)
-					break
-				}
-				binary = s
+			words, assembly := splitObjectDumpLine(line)
+			binary := strings.Join(words, "")
+			if isNop(assembly) {
+				continue
 			}
 			if lineNumber >= len(functions[functionName]) {
-				return fmt.Errorf("%d: unexpected objectdump line: %s", i, line)
+				return fmt.Errorf("%d: unexpected objectdump line: %s", i+1, line)
 			}
 			functions[functionName][lineNumber].Binary = binary
 			lineNumber++
@@ -168,40 +222,68 @@ func parseObjectDump(dump string, functions map[string][]Line) error {
 func (t *TranslateUnit) generateGoAssembly(path string, functions []Function) error {
 	// generate code
 	var builder strings.Builder
-	builder.WriteString(buildTags)
+	builder.WriteString(t.buildConstraint())
 	t.writeHeader(&builder)
-	for _, function := range functions {
+	if t.AutoNosplit {
+		builder.WriteString("#include \"textflag.h\"\n\n")
+	}
+	for _, function := range lo.ToSlicePtr(functions) {
 		returnSize := 0
 		if function.Type != "void" {
-			returnSize += 8
+			returnSize = function.ResultSize()
 		}
 		registerCount, fpRegisterCount, offset := 0, 0, 0
 		var stack []lo.Tuple2[int, Parameter]
 		var argsBuilder strings.Builder
-		for _, param := range function.Parameters {
+		for i, param := range function.Parameters {
+			if i == 0 && function.StructResult {
+				// the pointer to a struct result is passed in R8, loaded after spilling with it
+				function.Parameters[i].Register = "R8"
+				offset += 8
+				continue
+			}
 			sz := 8
 			if param.Pointer {
 				sz = 8
 			} else {
 				sz = supportedTypes[param.Type]
 			}
-			if offset%sz != 0 {
-				offset += sz - offset%sz
+			if align := param.Align(); offset%align != 0 {
+				offset += align - offset%align
 			}
-			if !param.Pointer && (param.Type == "float" || param.Type == "double") {
+			if part, ok := complexTypes[param.Type]; ok && !param.Pointer {
+				// the real and imaginary parts are passed in a pair of registers
+				if fpRegisterCount+2 > len(fpRegisters) {
+					return fmt.Errorf("%v: complex parameter %v does not fit in registers", function.Name, param.Name)
+				}
+				instruction, partSize := "FMOVD", 8
+				if part == "float" {
+					instruction, partSize = "FMOVS", 4
+				}
+				argsBuilder.WriteString(fmt.Sprintf("\t%s %s_real+%d(FP), %s\n", instruction, param.Name, offset, fpRegisters[fpRegisterCount]))
+				argsBuilder.WriteString(fmt.Sprintf("\t%s %s_imag+%d(FP), %s\n", instruction, param.Name, offset+partSize, fpRegisters[fpRegisterCount+1]))
+				function.Parameters[i].Register = fpRegisters[fpRegisterCount] + ", " + fpRegisters[fpRegisterCount+1]
+				fpRegisterCount += 2
+			} else if !param.Pointer && (param.Type == "float" || param.Type == "double") {
 				if fpRegisterCount < len(fpRegisters) {
 					if param.Type == "float" {
 						argsBuilder.WriteString(fmt.Sprintf("\tFMOVS %s+%d(FP), %s\n", param.Name, offset, fpRegisters[fpRegisterCount]))
 					} else {
 						argsBuilder.WriteString(fmt.Sprintf("\tFMOVD %s+%d(FP), %s\n", param.Name, offset, fpRegisters[fpRegisterCount]))
 					}
+					function.Parameters[i].Register = fpRegisters[fpRegisterCount]
 					fpRegisterCount++
 				} else {
 					stack = append(stack, lo.Tuple2[int, Parameter]{A: offset, B: param})
 				}
 			} else {
 				if registerCount < len(registers) {
-					argsBuilder.WriteString(fmt.Sprintf("\tMOVD %s+%d(FP), %s\n", param.Name, offset, registers[registerCount]))
+					if instruction, ok := narrowLoads[param.Type]; ok && !param.Pointer {
+						argsBuilder.WriteString(fmt.Sprintf("\t%s %s+%d(FP), %s\n", instruction, param.Name, offset, registers[registerCount]))
+					} else {
+						argsBuilder.WriteString(fmt.Sprintf("\tMOVD %s+%d(FP), %s\n", param.Name, offset, registers[registerCount]))
+					}
+					function.Parameters[i].Register = registers[registerCount]
 					registerCount++
 				} else {
 					stack = append(stack, lo.Tuple2[int, Parameter]{A: offset, B: param})
@@ -212,41 +294,50 @@ func (t *TranslateUnit) generateGoAssembly(path string, functions []Function) er
 		if offset%8 != 0 {
 			offset += 8 - offset%8
 		}
-		stackOffset := 0
-		if len(stack) > 0 {
-			for i := 0; i < len(stack); i++ {
-				argsBuilder.WriteString(fmt.Sprintf("\tMOVD %s+%d(FP), R8\n", stack[i].B.Name, stack[i].A))
-				argsBuilder.WriteString(fmt.Sprintf("\tMOVD R8, %d(RSP)\n", stackOffset))
-				if stack[i].B.Pointer {
-					stackOffset += 8
-				} else {
-					stackOffset += supportedTypes[stack[i].B.Type]
-				}
+		// each argument on the stack takes an 8-byte slot, whatever its size. If the frame
+		// reserves the stack of the C code, it lies between the link register saved at
+		// 0(RSP) and the arguments, on top of which the C code starts
+		stackSize := 8 * len(stack)
+		flags, reserved := t.textFlags(*function, stackSize, 0)
+		stackBase := 0
+		if reserved > 0 {
+			stackBase = 8 + reserved
+		}
+		for i, arg := range stack {
+			if instruction, ok := narrowLoads[arg.B.Type]; ok && !arg.B.Pointer {
+				argsBuilder.WriteString(fmt.Sprintf("\t%s %s+%d(FP), R8\n", instruction, arg.B.Name, arg.A))
+			} else {
+				argsBuilder.WriteString(fmt.Sprintf("\tMOVD %s+%d(FP), R8\n", arg.B.Name, arg.A))
 			}
+			argsBuilder.WriteString(fmt.Sprintf("\tMOVD R8, %d(RSP)\n", stackBase+8*i))
 		}
-		if stackOffset%8 != 0 {
-			stackOffset += 8 - stackOffset%8
+		if function.StructResult {
+			argsBuilder.WriteString(fmt.Sprintf("\tMOVD %s+0(FP), R8\n", function.Parameters[0].Name))
 		}
-		builder.WriteString(fmt.Sprintf("\nTEXT ·%v(SB), $%d-%d\n",
-			function.Name, stackOffset, offset+returnSize))
+		if stackBase > 0 {
+			argsBuilder.WriteString(fmt.Sprintf("\tADD $%d, RSP\n", stackBase))
+		}
+		function.FrameSize = stackSize + reserved
+		builder.WriteRune('\n')
+		if t.VerboseAsm {
+			writeFunctionComment(&builder, *function)
+		}
+		builder.WriteString(fmt.Sprintf("TEXT ·%v(SB), %s$%d-%d\n",
+			function.Name, flags, function.FrameSize, offset+returnSize))
 		builder.WriteString(argsBuilder.String())
 		for _, line := range function.Lines {
 			for _, label := range line.Labels {
 				builder.WriteString(label)
 				builder.WriteString(":\n")
 			}
-			if line.Assembly == "ret" {
-				if function.Type != "void" {
-					switch function.Type {
-					case "int64_t", "long", "_Bool":
-						builder.WriteString(fmt.Sprintf("\tMOVD R0, result+%d(FP)\n", offset))
-					case "double":
-						builder.WriteString(fmt.Sprintf("\tFMOVD F0, result+%d(FP)\n", offset))
-					case "float":
-						builder.WriteString(fmt.Sprintf("\tFMOVS F0, result+%d(FP)\n", offset))
-					default:
-						return fmt.Errorf("unsupported return type: %v", function.Type)
-					}
+			if retLine.MatchString(line.Assembly) {
+				if stackBase > 0 {
+					builder.WriteString(fmt.Sprintf("\tSUB $%d, RSP\n", stackBase))
+				}
+				if len(function.Results) > 0 {
+					writeStructResult(&builder, *function, offset)
+				} else if function.Type != "void" {
+					writeResult(&builder, *function, offset, registers[0], fpRegisters)
 				}
 				builder.WriteString("\tRET\n")
 			} else {
@@ -256,6 +347,10 @@ func (t *TranslateUnit) generateGoAssembly(path string, functions []Function) er
 	}
 
 	// write file
+	content, err := t.appendGenerated(path, builder.String())
+	if err != nil {
+		return err
+	}
 	f, err := os.Create(path)
 	if err != nil {
 		return err
@@ -266,10 +361,53 @@ func (t *TranslateUnit) generateGoAssembly(path string, functions []Function) er
 			os.Exit(1)
 		}
 	}(f)
-	bytes, err := asmfmt.Format(strings.NewReader(builder.String()))
+	bytes, err := asmfmt.Format(strings.NewReader(content))
 	if err != nil {
 		return err
 	}
+	if bytes, err = t.postProcess(bytes); err != nil {
+		return err
+	}
+	if t.VerifySelfContained {
+		if err = t.verifySelfContained(bytes); err != nil {
+			return err
+		}
+	}
 	_, err = f.Write(bytes)
 	return err
 }
+
+// writeStructResult stores the fields of a struct result of at most 16 bytes, which is
+// returned in F0 to F3 if its fields are all float or all double, or else in R0 and R1.
+func writeStructResult(builder *strings.Builder, function Function, offset int) {
+	offsets := function.ResultOffsets()
+	first := function.Results[0].Type
+	if (first == "float" || first == "double") && lo.EveryBy(function.Results, func(result Parameter) bool {
+		return result.Type == first
+	}) {
+		for i, result := range function.Results {
+			builder.WriteString(fmt.Sprintf("\t%s %s, %s+%d(FP)\n", floatStores[first], fpRegisters[i], result.Name, offset+offsets[i]))
+		}
+		return
+	}
+	writeIntegerStructResult(builder, function, offset, "LSR")
+}
+
+// writeIntegerStructResult stores the fields of a struct result of at most 16 bytes that
+// is returned in the first two integer registers, one for each eightbyte. Fields after
+// the first of an eightbyte are shifted down to the bottom of the register.
+func writeIntegerStructResult(builder *strings.Builder, function Function, offset int, shiftRight string) {
+	offsets := function.ResultOffsets()
+	shift := 0
+	for i, result := range function.Results {
+		register := registers[offsets[i]/8]
+		if i > 0 && offsets[i]/8 != offsets[i-1]/8 {
+			shift = 0
+		}
+		if rest := offsets[i] % 8; rest > shift {
+			builder.WriteString(fmt.Sprintf("\t%s $%d, %s\n", shiftRight, (rest-shift)*8, register))
+			shift = rest
+		}
+		builder.WriteString(fmt.Sprintf("\t%s %s, %s+%d(FP)\n", integerStores[supportedTypes[result.Type]], register, result.Name, offset+offsets[i]))
+	}
+}
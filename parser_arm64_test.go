@@ -0,0 +1,52 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAssemblyIndirectBranch(t *testing.T) {
+	for _, branch := range []string{"br\tx8", "blr\tx8", "braaz\tx8", "blrab\tx8, x9"} {
+		path := filepath.Join(t.TempDir(), "dispatch.s")
+		assembly := "dispatch:\n\tadr\tx9, .LJTI0_0\n\t" + branch + "\n\tret\n"
+		assert.NoError(t, os.WriteFile(path, []byte(assembly), 0644))
+		_, _, err := parseAssembly(path)
+		assert.EqualError(t, err, "dispatch: unsupported indirect branch: "+branch)
+	}
+}
+
+func TestUnsafeInstructions(t *testing.T) {
+	for asm, class := range map[string]string{
+		"movz\tx8, #:abs_g3:pool":    "absolute address",
+		"movk\tx8, #:abs_g2_nc:pool": "absolute address",
+		"movk\tx8, #:abs_g0_nc:pool": "absolute address",
+		"movz\tx8, #4660":            "",
+		"movk\tx8, #4660, lsl #16":   "",
+		"ldr\tx8, [x8, :lo12:pool]":  "",
+		"adrp\tx8, pool":             "PC-relative reference",
+		"bl\tsqrt":                   "call",
+	} {
+		assert.Equal(t, class, unsafeClass(asm), asm)
+	}
+}
+
+func TestParseObjectDumpWithoutOperands(t *testing.T) {
+	dump := strings.Join([]string{
+		"0000000000000000 <stream>:",
+		"   0:\td503477f \tsmstart",
+		"   4:\t8b010000 \tadd\tx0, x0, x1",
+		"   8:\td503467f \tsmstop",
+		"   c:\td65f03c0 \tret",
+	}, "\n")
+	functions := map[string][]Line{"stream": {
+		{Assembly: "smstart"}, {Assembly: "add\tx0, x0, x1"}, {Assembly: "smstop"}, {Assembly: "ret"},
+	}}
+	assert.NoError(t, parseObjectDump(dump, functions))
+	assert.Equal(t, []string{"d503477f", "8b010000", "d503467f", "d65f03c0"},
+		lo.Map(functions["stream"], func(line Line, _ int) string { return line.Binary }))
+}
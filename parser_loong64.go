@@ -32,11 +32,21 @@ const (
 
 var (
 	attributeLine = regexp.MustCompile(`^\s+\..+$`)
-	nameLine      = regexp.MustCompile(`^\w+:.+$`)
-	labelLine     = regexp.MustCompile(`^\.\w+_\d+:.*$`)
+	nameLine      = regexp.MustCompile(`^\w+:.*$`)
+	labelLine     = regexp.MustCompile(`^\.(\w+_\d+|L\d+):.*$`)
 	codeLine      = regexp.MustCompile(`^\s+\w+.+$`)
+	retLine       = regexp.MustCompile(`^(ret|jr\s+\$(r1|ra))$`)
 
-	symbolLine = regexp.MustCompile(`^\w+\s+<\w+>:$`)
+	// GOT and TLS relocations of global and thread-local variables
+	externalReference = regexp.MustCompile(`%(got_\w+|le_\w+|ie_\w+|gd_\w+|ld_\w+|desc_\w+)\(|^la\.(got|tls\.\w+)\s`)
+
+	// extra options of objdump
+	objdumpOptions []string
+
+	// accesses below the stack pointer, which is safe without a red zone
+	redZoneAccess *regexp.Regexp
+
+	symbolLine = regexp.MustCompile(`^(\w+\s+)?<\w+>:$`)
 	dataLine   = regexp.MustCompile(`^\w+:\s+\w+\s+.+$`)
 
 	registers   = []string{"R4", "R5", "R6", "R7", "R8", "R9", "R10", "R11"}
@@ -80,6 +90,43 @@ var (
 		"b":    "JMP",
 		"bnez": "BNE",
 	}
+
+	// register names, which the Go assembler does not accept as argument names
+	registerName = regexp.MustCompile(`^([RFVX]\d+|FCC\d+|FCSR\d+)$`)
+
+	// extending loads of parameters narrower than 8 bytes, float included, whose bits
+	// are loaded when it is passed in an integer register or on the stack
+	narrowLoads = map[string]string{
+		"int":           "MOVW",
+		"int32_t":       "MOVW",
+		"uint32_t":      "MOVWU",
+		"char":          "MOVB",
+		"signed char":   "MOVB",
+		"unsigned char": "MOVBU",
+		"_Bool":         "MOVBU",
+		"float":         "MOVWU",
+	}
+
+	// stores of results from their registers, keyed by size for integers and pointers and
+	// by type for floating-point numbers
+	integerStores = map[int]string{1: "MOVB", 4: "MOVW", 8: "MOVV"}
+	floatStores   = map[string]string{"float": "MOVF", "double": "MOVD"}
+
+	// the function called by an instruction
+	callTarget = regexp.MustCompile(`^bl\s+(?:%plt\()?(\w+)`)
+
+	// instructions that allocate stack, with a register operand if the size is only known at run time
+	stackAllocators = []stackAllocator{
+		{Pattern: regexp.MustCompile(`^(?:addi\.d\s+\$sp,\s*\$sp,\s*-(\d+)|sub\.d\s+\$sp,\s*\$sp,)`)},
+	}
+
+	unsafeInstructions = []instructionClass{
+		{Name: "call", Pattern: regexp.MustCompile(`^bl\s`)},
+		{Name: "indirect branch", Pattern: regexp.MustCompile(`^(jr|jirl)\s`)},
+		{Name: "PC-relative reference", Pattern: regexp.MustCompile(`^(pcalau12i|pcaddi|pcaddu12i|pcaddu18i|la(\.\w+)*)\s`)},
+		{Name: "absolute address", Pattern: regexp.MustCompile(`%abs(64)?_\w+\(`)},
+		{Name: "thread-local reference", Pattern: regexp.MustCompile(`\$tp\b`)},
+	}
 )
 
 type Line struct {
@@ -161,6 +208,14 @@ func parseAssembly(path string) (map[string][]Line, map[string]int, error) {
 		} else if codeLine.MatchString(line) {
 			asm := strings.Split(line, "//")[0]
 			asm = strings.TrimSpace(asm)
+			if err := checkExternalReference(functionName, asm); err != nil {
+				return nil, nil, err
+			}
+			addStackAllocation(stackSizes, functionName, asm)
+			if isNop(asm) {
+				// nops are skipped in the object dump as padding, and labels move to the next instruction
+				continue
+			}
 			if labelName == "" {
 				functions[functionName] = append(functions[functionName], Line{Assembly: asm})
 			} else {
@@ -191,26 +246,13 @@ func parseObjectDump(dump string, functions map[string][]Line) error {
 			functionName = strings.Split(functionName, ">")[0]
 			lineNumber = 0
 		} else if dataLine.MatchString(line) {
-			data := strings.Split(line, ":")[1]
-			data = strings.TrimSpace(data)
-			splits := strings.Split(data, " ")
-			var (
-				binary   string
-				assembly string
-			)
-			for i, s := range splits {
-				if s == "" || unicode.IsSpace(rune(s[0])) {
-					assembly = strings.Join(splits[i:], " ")
-					assembly = strings.TrimSpace(assembly)
-					break
-				}
-				binary = s
-			}
-			if assembly == "nop" {
+			words, assembly := splitObjectDumpLine(line)
+			binary := strings.Join(words, "")
+			if isNop(assembly) {
 				continue
 			}
 			if lineNumber >= len(functions[functionName]) {
-				return fmt.Errorf("%d: unexpected objectdump line: %s", i, line)
+				return fmt.Errorf("%d: unexpected objectdump line: %s", i+1, line)
 			}
 			functions[functionName][lineNumber].Binary = binary
 			lineNumber++
@@ -222,41 +264,59 @@ func parseObjectDump(dump string, functions map[string][]Line) error {
 func (t *TranslateUnit) generateGoAssembly(path string, functions []Function) error {
 	// generate code
 	var builder strings.Builder
-	builder.WriteString(buildTags)
+	builder.WriteString(t.buildConstraint())
 	t.writeHeader(&builder)
-	for _, function := range functions {
+	if t.AutoNosplit {
+		builder.WriteString("#include \"textflag.h\"\n\n")
+	}
+	for _, function := range lo.ToSlicePtr(functions) {
 		returnSize := 0
 		if function.Type != "void" {
 			returnSize += 8
 		}
-		builder.WriteString(fmt.Sprintf("\nTEXT ·%v(SB), $%d-%d\n",
-			function.Name, returnSize, len(function.Parameters)*8))
 		registerCount, fpRegisterCount, offset := 0, 0, 0
 		var stack []lo.Tuple2[int, Parameter]
-		for _, param := range function.Parameters {
+		var argsBuilder strings.Builder
+		for i, param := range function.Parameters {
 			sz := 8
 			if param.Pointer {
 				sz = 8
 			} else {
 				sz = supportedTypes[param.Type]
 			}
-			if offset%sz != 0 {
-				offset += sz - offset%sz
+			if align := param.Align(); offset%align != 0 {
+				offset += align - offset%align
 			}
-			if !param.Pointer && (param.Type == "double" || param.Type == "float") {
-				if fpRegisterCount < len(fpRegisters) {
-					if param.Type == "double" {
-						builder.WriteString(fmt.Sprintf("\tMOVD %s+%d(FP), %s\n", param.Name, offset, fpRegisters[fpRegisterCount]))
-					} else {
-						builder.WriteString(fmt.Sprintf("\tMOVF %s+%d(FP), %s\n", param.Name, offset, fpRegisters[fpRegisterCount]))
-					}
-					fpRegisterCount++
+			if part, ok := complexTypes[param.Type]; ok && !param.Pointer {
+				// the real and imaginary parts are passed in a pair of registers
+				if fpRegisterCount+2 > len(fpRegisters) {
+					return fmt.Errorf("%v: complex parameter %v does not fit in registers", function.Name, param.Name)
+				}
+				instruction, partSize := "MOVD", 8
+				if part == "float" {
+					instruction, partSize = "MOVF", 4
+				}
+				argsBuilder.WriteString(fmt.Sprintf("\t%s %s_real+%d(FP), %s\n", instruction, param.Name, offset, fpRegisters[fpRegisterCount]))
+				argsBuilder.WriteString(fmt.Sprintf("\t%s %s_imag+%d(FP), %s\n", instruction, param.Name, offset+partSize, fpRegisters[fpRegisterCount+1]))
+				function.Parameters[i].Register = fpRegisters[fpRegisterCount] + ", " + fpRegisters[fpRegisterCount+1]
+				fpRegisterCount += 2
+			} else if !param.Pointer && (param.Type == "double" || param.Type == "float") && fpRegisterCount < len(fpRegisters) {
+				if param.Type == "double" {
+					argsBuilder.WriteString(fmt.Sprintf("\tMOVD %s+%d(FP), %s\n", param.Name, offset, fpRegisters[fpRegisterCount]))
 				} else {
-					stack = append(stack, lo.Tuple2[int, Parameter]{A: offset, B: param})
+					argsBuilder.WriteString(fmt.Sprintf("\tMOVF %s+%d(FP), %s\n", param.Name, offset, fpRegisters[fpRegisterCount]))
 				}
+				function.Parameters[i].Register = fpRegisters[fpRegisterCount]
+				fpRegisterCount++
 			} else {
+				// once the floating-point registers run out, floats are passed like integers
 				if registerCount < len(registers) {
-					builder.WriteString(fmt.Sprintf("\tMOVV %s+%d(FP), %s\n", param.Name, offset, registers[registerCount]))
+					if instruction, ok := narrowLoads[param.Type]; ok && !param.Pointer {
+						argsBuilder.WriteString(fmt.Sprintf("\t%s %s+%d(FP), %s\n", instruction, param.Name, offset, registers[registerCount]))
+					} else {
+						argsBuilder.WriteString(fmt.Sprintf("\tMOVV %s+%d(FP), %s\n", param.Name, offset, registers[registerCount]))
+					}
+					function.Parameters[i].Register = registers[registerCount]
 					registerCount++
 				} else {
 					stack = append(stack, lo.Tuple2[int, Parameter]{A: offset, B: param})
@@ -267,47 +327,48 @@ func (t *TranslateUnit) generateGoAssembly(path string, functions []Function) er
 		if offset%8 != 0 {
 			offset += 8 - offset%8
 		}
-		frameSize := 0
-		if len(stack) > 0 {
-			for i := 0; i < len(stack); i++ {
-				if stack[i].B.Pointer {
-					frameSize += 8
-				} else {
-					frameSize += supportedTypes[stack[i].B.Type]
-				}
-			}
-			builder.WriteString(fmt.Sprintf("\tADDV $-%d, R3\n", frameSize))
-			stackoffset := 0
-			for i := 0; i < len(stack); i++ {
-				builder.WriteString(fmt.Sprintf("\tMOVV %s+%d(FP), R12\n", stack[i].B.Name, frameSize+stack[i].A))
-				builder.WriteString(fmt.Sprintf("\tMOVV R12, (%d)(R3)\n", stackoffset))
-				if stack[i].B.Pointer {
-					stackoffset += 8
+		// each argument on the stack takes an 8-byte slot, whatever its size. The arguments
+		// are copied below the stack pointer before moving it, so that their offsets from FP
+		// are the ones declared by the stub, unless the frame reserves the stack of the C
+		// code, which lies between the return address saved at 0(SP) and the arguments
+		stackSize := 8 * len(stack)
+		flags, reserved := t.textFlags(*function, returnSize, stackSize)
+		stackBase := -stackSize
+		if reserved > 0 {
+			stackBase = 8 + reserved - stackSize
+		}
+		if stackBase != 0 {
+			for i, arg := range stack {
+				if instruction, ok := narrowLoads[arg.B.Type]; ok && !arg.B.Pointer {
+					argsBuilder.WriteString(fmt.Sprintf("\t%s %s+%d(FP), R12\n", instruction, arg.B.Name, arg.A))
 				} else {
-					stackoffset += supportedTypes[stack[i].B.Type]
+					argsBuilder.WriteString(fmt.Sprintf("\tMOVV %s+%d(FP), R12\n", arg.B.Name, arg.A))
 				}
+				argsBuilder.WriteString(fmt.Sprintf("\tMOVV R12, (%d)(R3)\n", stackBase+8*i))
 			}
+			argsBuilder.WriteString(fmt.Sprintf("\tADDV $%d, R3\n", stackBase))
+		}
+		function.FrameSize = returnSize + reserved
+		builder.WriteRune('\n')
+		if t.VerboseAsm {
+			writeFunctionComment(&builder, *function)
 		}
+		builder.WriteString(fmt.Sprintf("TEXT ·%v(SB), %s$%d-%d\n",
+			function.Name, flags, function.FrameSize, offset+function.ResultSize()))
+		builder.WriteString(argsBuilder.String())
 		for _, line := range function.Lines {
 			for _, label := range line.Labels {
 				builder.WriteString(label)
 				builder.WriteString(":\n")
 			}
-			if line.Assembly == "ret" {
-				if frameSize > 0 {
-					builder.WriteString(fmt.Sprintf("\tADDV $%d, R3\n", frameSize))
+			if retLine.MatchString(line.Assembly) {
+				if stackBase != 0 {
+					builder.WriteString(fmt.Sprintf("\tADDV $%d, R3\n", -stackBase))
 				}
-				if function.Type != "void" {
-					switch function.Type {
-					case "int64_t", "long", "_Bool":
-						builder.WriteString(fmt.Sprintf("\tMOVV R4, result+%d(FP)\n", offset))
-					case "double":
-						builder.WriteString(fmt.Sprintf("\tMOVD F0, result+%d(FP)\n", offset))
-					case "float":
-						builder.WriteString(fmt.Sprintf("\tMOVF F0, result+%d(FP)\n", offset))
-					default:
-						return fmt.Errorf("unsupported return type: %v", function.Type)
-					}
+				if len(function.Results) > 0 {
+					writeStructResult(&builder, *function, offset)
+				} else if function.Type != "void" {
+					writeResult(&builder, *function, offset, registers[0], fpRegisters)
 				}
 				builder.WriteString("\tRET\n")
 			} else {
@@ -317,6 +378,10 @@ func (t *TranslateUnit) generateGoAssembly(path string, functions []Function) er
 	}
 
 	// write file
+	content, err := t.appendGenerated(path, builder.String())
+	if err != nil {
+		return err
+	}
 	f, err := os.Create(path)
 	if err != nil {
 		return err
@@ -327,10 +392,60 @@ func (t *TranslateUnit) generateGoAssembly(path string, functions []Function) er
 			os.Exit(1)
 		}
 	}(f)
-	bytes, err := asmfmt.Format(strings.NewReader(builder.String()))
+	bytes, err := asmfmt.Format(strings.NewReader(content))
 	if err != nil {
 		return err
 	}
+	if bytes, err = t.postProcess(bytes); err != nil {
+		return err
+	}
+	if t.VerifySelfContained {
+		if err = t.verifySelfContained(bytes); err != nil {
+			return err
+		}
+	}
 	_, err = f.Write(bytes)
 	return err
 }
+
+// writeStructResult stores the fields of a struct result of at most 16 bytes. A struct
+// of one float, two floats, or a float and an integer is returned with the floats in
+// F0 and F1 and the integer in R4, and any other struct in R4 and R5.
+func writeStructResult(builder *strings.Builder, function Function, offset int) {
+	offsets := function.ResultOffsets()
+	floats := lo.CountBy(function.Results, func(result Parameter) bool {
+		return result.Type == "float" || result.Type == "double"
+	})
+	if (len(function.Results) == 1 && floats == 1) || (len(function.Results) == 2 && floats > 0) {
+		fpRegisterIndex := 0
+		for i, result := range function.Results {
+			if store, ok := floatStores[result.Type]; ok {
+				builder.WriteString(fmt.Sprintf("\t%s %s, %s+%d(FP)\n", store, fpRegisters[fpRegisterIndex], result.Name, offset+offsets[i]))
+				fpRegisterIndex++
+			} else {
+				builder.WriteString(fmt.Sprintf("\t%s %s, %s+%d(FP)\n", integerStores[supportedTypes[result.Type]], registers[0], result.Name, offset+offsets[i]))
+			}
+		}
+		return
+	}
+	writeIntegerStructResult(builder, function, offset, "SRLV")
+}
+
+// writeIntegerStructResult stores the fields of a struct result of at most 16 bytes that
+// is returned in the first two integer registers, one for each eightbyte. Fields after
+// the first of an eightbyte are shifted down to the bottom of the register.
+func writeIntegerStructResult(builder *strings.Builder, function Function, offset int, shiftRight string) {
+	offsets := function.ResultOffsets()
+	shift := 0
+	for i, result := range function.Results {
+		register := registers[offsets[i]/8]
+		if i > 0 && offsets[i]/8 != offsets[i-1]/8 {
+			shift = 0
+		}
+		if rest := offsets[i] % 8; rest > shift {
+			builder.WriteString(fmt.Sprintf("\t%s $%d, %s\n", shiftRight, (rest-shift)*8, register))
+			shift = rest
+		}
+		builder.WriteString(fmt.Sprintf("\t%s %s, %s+%d(FP)\n", integerStores[supportedTypes[result.Type]], register, result.Name, offset+offsets[i]))
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnsafeInstructions(t *testing.T) {
+	for asm, class := range map[string]string{
+		"lu12i.w\t$a0, %abs_hi20(pool)":        "absolute address",
+		"ori\t$a0, $a0, %abs_lo12(pool)":       "absolute address",
+		"lu32i.d\t$a0, %abs64_lo20(pool)":      "absolute address",
+		"lu52i.d\t$a0, $a0, %abs64_hi12(pool)": "absolute address",
+		"lu12i.w\t$a0, 74565":                  "",
+		"addi.d\t$a0, $a0, %pc_lo12(pool)":     "",
+		"pcalau12i\t$a0, %pc_hi20(pool)":       "PC-relative reference",
+		"bl\tsqrt":                             "call",
+	} {
+		assert.Equal(t, class, unsafeClass(asm), asm)
+	}
+}
+
+func TestFrameArgs(t *testing.T) {
+	dir := t.TempDir()
+	translateUnit := NewTranslateUnit(filepath.Join(dir, "args.c"), dir)
+	translateUnit.ParseOnly = true
+	translateUnit.AutoNosplit = true
+	params := func(types ...string) []Parameter {
+		var parameters []Parameter
+		for i, typeName := range types {
+			parameters = append(parameters, Parameter{Name: string(rune('a' + i)), ParameterType: ParameterType{Type: typeName}})
+		}
+		return parameters
+	}
+	ret := []Line{{Assembly: "ret"}}
+	functions := []Function{
+		{Name: "chars", Type: "long", Lines: ret, Parameters: params("char", "char", "long")},
+		{Name: "floats", Type: "float", Lines: ret, Parameters: params("float", "float", "double")},
+		{Name: "mixed", Type: "double", Lines: ret, Parameters: params("char", "float", "int", "double", "long")},
+		{Name: "byte", Type: "void", Lines: ret, Parameters: params("unsigned char")},
+	}
+	assert.NoError(t, translateUnit.generateGoAssembly(translateUnit.GoAssembly, functions))
+	data, err := os.ReadFile(translateUnit.GoAssembly)
+	assert.NoError(t, err)
+	// the arguments are packed by their alignment, and the result starts at the next word
+	assembly := regexp.MustCompile(` +`).ReplaceAllString(string(data), " ")
+	for _, text := range []string{
+		"TEXT ·chars(SB), NOSPLIT, $8-24\n\tMOVB a+0(FP), R4\n\tMOVB b+1(FP), R5\n\tMOVV c+8(FP), ",
+		"\tMOVV R4, result+16(FP)\n",
+		"TEXT ·floats(SB), NOSPLIT, $8-20\n\tMOVF a+0(FP), F0\n\tMOVF b+4(FP), F1\n\tMOVD c+8(FP), ",
+		"\tMOVF F0, result+16(FP)\n",
+		"TEXT ·mixed(SB), NOSPLIT, $8-40\n\tMOVB a+0(FP), R4\n\tMOVF b+4(FP), F0\n\tMOVW c+8(FP), R5\n\tMOVD d+16(FP), F1\n\tMOVV e+24(FP), ",
+		"\tMOVD F0, result+32(FP)\n",
+		"TEXT ·byte(SB), NOSPLIT, $0-8\n\tMOVBU a+0(FP), R4\n\tRET\n",
+	} {
+		assert.Contains(t, assembly, text)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnsafeInstructions(t *testing.T) {
+	for asm, class := range map[string]string{
+		"lui\ta0, %hi(pool)":               "absolute address",
+		"addi\ta0, a0, %lo(pool)":          "absolute address",
+		"ld\ta0, %lo(pool)(a0)":            "absolute address",
+		"addi\ta0, a0, %pcrel_lo(.Lpcrel)": "",
+		"lui\ta0, 74565":                   "",
+		"ld\ta0, 8(a0)":                    "",
+		"auipc\ta0, %pcrel_hi(pool)":       "PC-relative reference",
+		"call\tsqrt":                       "call",
+	} {
+		assert.Equal(t, class, unsafeClass(asm), asm)
+	}
+}
+
+func TestFrameArgs(t *testing.T) {
+	dir := t.TempDir()
+	translateUnit := NewTranslateUnit(filepath.Join(dir, "args.c"), dir)
+	translateUnit.ParseOnly = true
+	translateUnit.AutoNosplit = true
+	params := func(types ...string) []Parameter {
+		var parameters []Parameter
+		for i, typeName := range types {
+			parameters = append(parameters, Parameter{Name: string(rune('a' + i)), ParameterType: ParameterType{Type: typeName}})
+		}
+		return parameters
+	}
+	ret := []Line{{Assembly: "ret"}}
+	functions := []Function{
+		{Name: "chars", Type: "long", Lines: ret, Parameters: params("char", "char", "long")},
+		{Name: "floats", Type: "float", Lines: ret, Parameters: params("float", "float", "double")},
+		{Name: "mixed", Type: "double", Lines: ret, Parameters: params("char", "float", "int", "double", "long")},
+		{Name: "byte", Type: "void", Lines: ret, Parameters: params("unsigned char")},
+	}
+	assert.NoError(t, translateUnit.generateGoAssembly(translateUnit.GoAssembly, functions))
+	data, err := os.ReadFile(translateUnit.GoAssembly)
+	assert.NoError(t, err)
+	// the arguments are packed by their alignment, and the result starts at the next word
+	assembly := regexp.MustCompile(` +`).ReplaceAllString(string(data), " ")
+	for _, text := range []string{
+		"TEXT ·chars(SB), NOSPLIT, $8-24\n\tMOVBU a+0(FP), A0\n\tMOVBU b+1(FP), A1\n\tMOV c+8(FP), ",
+		"\tMOV A0, result+16(FP)\n",
+		"TEXT ·floats(SB), NOSPLIT, $8-20\n\tMOVF a+0(FP), FA0\n\tMOVF b+4(FP), FA1\n\tMOVD c+8(FP), ",
+		"\tMOVF FA0, result+16(FP)\n",
+		"TEXT ·mixed(SB), NOSPLIT, $8-40\n\tMOVBU a+0(FP), A0\n\tMOVF b+4(FP), FA0\n\tMOVW c+8(FP), A1\n\tMOVD d+16(FP), FA1\n\tMOV e+24(FP), ",
+		"\tMOVD FA0, result+32(FP)\n",
+		"TEXT ·byte(SB), NOSPLIT, $0-8\n\tMOVBU a+0(FP), A0\n\tRET\n",
+	} {
+		assert.Contains(t, assembly, text)
+	}
+}
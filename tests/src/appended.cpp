@@ -0,0 +1,22 @@
+// C++ source, of which only the extern "C" functions are translated
+
+long cxx_only(const long &x)
+{
+    return x;
+}
+
+extern "C" {
+
+long twice(long x)
+{
+    auto y = static_cast<long>(x);
+    return x + y;
+}
+
+// __powidf2 is only replaced by a multiplication from -O1 on
+double square(double x)
+{
+    return __builtin_powi(x, 2);
+}
+
+}
@@ -0,0 +1,5 @@
+// defines helper like square.c, which --symbol-prefix translates into the same package
+long helper(long x)
+{
+    return x * 2;
+}
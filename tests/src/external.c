@@ -0,0 +1,7 @@
+// calls a function outside of the generated assembly, which --verify-selfcontained rejects
+void report(long x);
+
+void notify(long x)
+{
+    report(x);
+}
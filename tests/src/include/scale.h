@@ -0,0 +1,3 @@
+// Not next to scaled.c, so that it is only found through -I tests/src/include.
+
+#define INCLUDED_SCALE 3
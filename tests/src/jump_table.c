@@ -0,0 +1,13 @@
+// dispatches through a jump table, which arm64 enters with br and goat rejects
+long dispatch(long op, long x)
+{
+    switch (op) {
+    case 0: return x + 1;
+    case 1: return x * 3;
+    case 2: return x - 7;
+    case 3: return x << 2;
+    case 4: return x ^ 5;
+    case 5: return x / 3;
+    default: return 0;
+    }
+}
@@ -0,0 +1,6 @@
+// loads a constant from a constant pool, whose absolute address is materialized
+// with --code-model large -e -fno-pic, which --strict rejects
+double tenth(double x)
+{
+    return x * 0.1;
+}
@@ -0,0 +1,6 @@
+// keeps a local array below the stack pointer when -mred-zone is given, which goat rejects
+long pick(long a, long b, long c, long d, long i)
+{
+    volatile long values[4] = {a, b, c, d};
+    return values[i & 3];
+}
@@ -0,0 +1,7 @@
+// includes a header of another directory, which both the C parser and clang find through -I
+#include <scale.h>
+
+long scaled(long x)
+{
+    return x * INCLUDED_SCALE;
+}
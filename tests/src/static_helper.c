@@ -0,0 +1,10 @@
+// the static helper is inlined and dropped by the compiler at -O2, which goat reports
+static long square(long x)
+{
+    return x * x;
+}
+
+long sum_squares(long a, long b)
+{
+    return square(a) + square(b);
+}
@@ -0,0 +1,7 @@
+// reads a thread-local variable defined elsewhere, which goat rejects as external state
+extern _Thread_local long counter;
+
+long next_count(void)
+{
+    return ++counter;
+}
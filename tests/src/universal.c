@@ -1,3 +1,5 @@
+#include "universal.h"
+
 long add(long a, long b)
 {
     return a + b;
@@ -51,6 +53,12 @@ long sum(long x1, long x2, long x3, long x4, long x5, long x6, long x7, long x8,
     return x1 + x2 + x3 + x4 + x5 + x6 + x7 + x8 + x9 + x10;
 }
 
+// passes the floats after the eighth like integers or on the stack, in 8-byte slots
+float sum_floats(float x1, float x2, float x3, float x4, float x5, float x6, float x7, float x8, float x9, float x10)
+{
+    return (x1 + x2 + x3 + x4 + x5 + x6 + x7 + x8) * x9 - x10;
+}
+
 double mul(float v1, double v2, float v3, float v4, double v5, double v6, long v7, double v8)
 {
     return v1 * v2 * v3 * v4 * v5 * v6 * v7 * v8;
@@ -65,3 +73,276 @@ void reverse(float *x1, float *x2, float *x3, float *x4, float *x5, float *x6, f
     tmp = *x4; *x4 = *x7; *x7 = tmp;
     tmp = *x5; *x5 = *x6; *x6 = tmp;
 }
+
+enum direction
+{
+    LEFT = -1,
+    RIGHT = 1
+};
+
+enum direction flip(enum direction d, int steps)
+{
+    return steps % 2 == 0 ? d : -d;
+}
+
+long long mul_ll(long long a, unsigned long long b)
+{
+    return a * (long long)b;
+}
+
+unsigned long long shl_ull(unsigned long long a, int n)
+{
+    return a << n;
+}
+
+void divmod(long a, long b, long *out_q, long *r_out)
+{
+    *out_q = a / b;
+    *r_out = a % b;
+}
+
+float _Complex cadd_f(float _Complex a, float _Complex b)
+{
+    return a + b;
+}
+
+double _Complex cadd_d(int n, double _Complex a, double b)
+{
+    return a + n * b;
+}
+
+__attribute__((used)) static inline long triple(long x)
+{
+    return 3 * x;
+}
+
+// goat:export
+extern inline long quadruple(long x)
+{
+    return 4 * x;
+}
+
+struct big
+{
+    long a;
+    double b;
+    long c;
+    double d;
+};
+
+struct big make_big(long a, double b)
+{
+    struct big r = {a, b, a + 1, b + b};
+    return r;
+}
+
+struct bounds
+{
+    float min, max;
+};
+
+struct bounds minmax(const float *x, long n)
+{
+    struct bounds r = {x[0], x[0]};
+    for (long i = 1; i < n; i++)
+    {
+        if (x[i] < r.min)
+            r.min = x[i];
+        if (x[i] > r.max)
+            r.max = x[i];
+    }
+    return r;
+}
+
+struct total
+{
+    long count;
+    double sum;
+};
+
+struct total sum_positive(const double *x, long n)
+{
+    struct total r = {0, 0};
+    for (long i = 0; i < n; i++)
+    {
+        if (x[i] > 0)
+        {
+            r.count++;
+            r.sum += x[i];
+        }
+    }
+    return r;
+}
+
+struct histogram
+{
+    int below;
+    float threshold;
+    long above;
+};
+
+struct histogram make_histogram(int n, float limit, long m)
+{
+    struct histogram r = {n, limit, m};
+    return r;
+}
+
+// LP64 definitions, declared here to keep the tests free of system headers
+typedef unsigned long size_t;
+typedef long ssize_t;
+typedef long intptr_t;
+
+ssize_t find(const long *x, size_t n, long v)
+{
+    for (size_t i = 0; i < n; i++)
+    {
+        if (x[i] == v)
+        {
+            return i;
+        }
+    }
+    return -1;
+}
+
+intptr_t distance(const long *a, const long *b)
+{
+    return (intptr_t)b - (intptr_t)a;
+}
+
+int widen(char c, signed char s, unsigned char u)
+{
+    return c + s + u;
+}
+
+signed char negate_sc(signed char x)
+{
+    return -x;
+}
+
+unsigned char low_byte(long x)
+{
+    return x;
+}
+
+char next_char(char c)
+{
+    return c + 1;
+}
+
+long rename(long type, long g, long)
+{
+    return type - g;
+}
+
+int answer(void)
+{
+    return 42;
+}
+
+double trace4(const double m[restrict 16], float unused[4], long rows[][2])
+{
+    return m[0] + m[5] + m[10] + m[15] + rows[1][0];
+}
+
+float sum_f(const float *in, size_t n)
+{
+    float sum = 0;
+    for (size_t i = 0; i < n; i++)
+        sum += in[i];
+    return sum;
+}
+
+float mix(float a, int b, signed char c)
+{
+    return a + b + c;
+}
+
+_Static_assert(sizeof(long) == 8, "long must be 64 bits");
+
+#define twice_of(x) _Generic((x), float: (x) * 2.0f, default: (x) * 2)
+
+long generic_twice(long x)
+{
+    _Alignas(8) long y = twice_of(x);
+    return y;
+}
+
+// keeps a buffer on the stack, which is too large for NOSPLIT
+long stack_buffer(long n)
+{
+    volatile long buffer[64];
+    for (int i = 0; i < 64; i++)
+        buffer[i] = n + i;
+    long sum = 0;
+    for (int i = 0; i < 64; i++)
+        sum += buffer[i];
+    return sum;
+}
+
+double sqrt(double x);
+
+// lowered to an instruction with -fbuiltin, which must follow the default -fno-builtin
+double root(double x)
+{
+    return sqrt(x);
+}
+
+// goat:length v=4
+double sum4(const double *v)
+{
+    return v[0] + v[1] + v[2] + v[3];
+}
+
+#ifdef ENABLE_SCALE
+// defined with -D ENABLE_SCALE -D SCALE=3
+long scale(long x)
+{
+    return x * SCALE;
+}
+#endif
+
+// declared in universal.h
+long forward(long x)
+{
+    return x + 1;
+}
+
+// the result points into the parameter
+void *advance(void *p, long n)
+{
+    return (char *)p + n;
+}
+
+long count_true(const _Bool *flags, long n)
+{
+    long count = 0;
+    for (long i = 0; i < n; i++)
+    {
+        count += flags[i];
+    }
+    return count;
+}
+
+// as in stdint.h, which is not included so that the tests need no C library headers
+typedef int int32_t;
+typedef unsigned int uint32_t;
+
+int32_t sub32(int32_t a, int32_t b)
+{
+    return a - b;
+}
+
+uint32_t max32(uint32_t a, uint32_t b)
+{
+    return a > b ? a : b;
+}
+
+long load_atomic(const _Atomic long *counter)
+{
+    return *counter;
+}
+
+long add_atomic(_Atomic(long) a, long b)
+{
+    return a + b;
+}
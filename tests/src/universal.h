@@ -0,0 +1,8 @@
+// Functions defined in headers are compiled with the source but not translated.
+
+long header_only(long x)
+{
+    return x;
+}
+
+long forward(long x);
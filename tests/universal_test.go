@@ -1,12 +1,26 @@
 package tests
 
 import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
 	"testing"
 	"unsafe"
 
 	"github.com/stretchr/testify/assert"
 )
 
+// assemblyFile is the assembly of the target architecture, which shares universal.go
+// with the other architectures.
+var assemblyFile = "universal_" + runtime.GOARCH + ".s"
+
 func TestAdd(t *testing.T) {
 	a := int64(1)
 	b := int64(2)
@@ -41,6 +55,11 @@ func TestSum(t *testing.T) {
 	assert.Equal(t, int64(55), sum(1, 2, 3, 4, 5, 6, 7, 8, 9, 10))
 }
 
+func TestSumFloats(t *testing.T) {
+	assert.Equal(t, float32(314), sum_floats(1, 2, 3, 4, 5, 6, 7, 8, 9, 10))
+	assert.Equal(t, float32(-1), sum_floats(1, 0, 0, 0, 0, 0, 0, 0, 0, 1))
+}
+
 func TestMul(t *testing.T) {
 	assert.Equal(t, float64(40320), mul(1, 2, 3, 4, 5, 6, 7, 8))
 }
@@ -51,3 +70,310 @@ func TestReverse(t *testing.T) {
 		unsafe.Pointer(&a[5]), unsafe.Pointer(&a[6]), unsafe.Pointer(&a[7]), unsafe.Pointer(&a[8]), unsafe.Pointer(&a[9]))
 	assert.Equal(t, []float32{10, 9, 8, 7, 6, 5, 4, 3, 2, 1}, a)
 }
+
+func TestFlip(t *testing.T) {
+	assert.Equal(t, int32(1), flip(-1, 3))
+	assert.Equal(t, int32(-1), flip(-1, 4))
+}
+
+func TestMulLL(t *testing.T) {
+	assert.Equal(t, int64(-6), mul_ll(-2, 3))
+}
+
+func TestShlULL(t *testing.T) {
+	assert.Equal(t, uint64(1<<63), shl_ull(1, 63))
+}
+
+func TestDivmod(t *testing.T) {
+	var q, r int64
+	divmod(17, 5, unsafe.Pointer(&q), unsafe.Pointer(&r))
+	assert.Equal(t, int64(3), q)
+	assert.Equal(t, int64(2), r)
+	// output pointers are documented and may escape
+	stubs, err := os.ReadFile("universal.go")
+	assert.NoError(t, err)
+	assert.True(t, strings.Contains(string(stubs), "\n// divmod writes its results to out_q, r_out.\nfunc divmod("))
+}
+
+func TestSymbolPrefix(t *testing.T) {
+	assert.Equal(t, int64(6), double_helper(3))
+	assert.Equal(t, int64(9), square_helper(3))
+}
+
+func TestIncludePath(t *testing.T) {
+	// INCLUDED_SCALE is defined in tests/src/include/scale.h
+	assert.Equal(t, int64(9), scaled(3))
+}
+
+func TestCaddF(t *testing.T) {
+	assert.Equal(t, complex64(4+6i), cadd_f(1+2i, 3+4i))
+}
+
+func TestCaddD(t *testing.T) {
+	assert.Equal(t, complex128(7+2i), cadd_d(3, 1+2i, 2))
+}
+
+func TestExportedInline(t *testing.T) {
+	assert.Equal(t, int64(15), triple(5))
+	assert.Equal(t, int64(20), quadruple(5))
+}
+
+func TestMakeBig(t *testing.T) {
+	type big struct {
+		a int64
+		b float64
+		c int64
+		d float64
+	}
+	var r big
+	make_big(unsafe.Pointer(&r), 1, 2.5)
+	assert.Equal(t, big{1, 2.5, 2, 5}, r)
+}
+
+func TestStructResult(t *testing.T) {
+	x := []float32{3, -1, 4, 1, 5}
+	min, max := minmax(unsafe.Pointer(&x[0]), int64(len(x)))
+	assert.Equal(t, float32(-1), min)
+	assert.Equal(t, float32(5), max)
+	count, sum := sum_positive(unsafe.Pointer(&[]float64{1.5, -2, 3}[0]), 3)
+	assert.Equal(t, int64(2), count)
+	assert.Equal(t, 4.5, sum)
+	below, threshold, above := make_histogram(3, 3.5, 2)
+	assert.Equal(t, int32(3), below)
+	assert.Equal(t, float32(3.5), threshold)
+	assert.Equal(t, int64(2), above)
+}
+
+func TestFind(t *testing.T) {
+	x := []int64{3, 1, 4, 1, 5}
+	assert.Equal(t, int64(2), find(unsafe.Pointer(&x[0]), uint64(len(x)), 4))
+	assert.Equal(t, int64(-1), find(unsafe.Pointer(&x[0]), uint64(len(x)), 9))
+}
+
+func TestDistance(t *testing.T) {
+	x := []int64{3, 1, 4, 1, 5}
+	assert.Equal(t, int64(16), distance(unsafe.Pointer(&x[0]), unsafe.Pointer(&x[2])))
+}
+
+func TestManifest(t *testing.T) {
+	data, err := os.ReadFile("universal.json")
+	if os.IsNotExist(err) {
+		t.Skip("generated without --manifest")
+	}
+	assert.NoError(t, err)
+	var manifest struct {
+		Functions []struct {
+			Name       string
+			Symbol     string
+			Parameters []struct {
+				Name     string
+				GoType   string `json:"go_type"`
+				Register string
+				Stack    bool
+			}
+		}
+	}
+	assert.NoError(t, json.Unmarshal(data, &manifest))
+	assert.Equal(t, "add", manifest.Functions[0].Name)
+	assert.Equal(t, "tests.add", manifest.Functions[0].Symbol)
+	for _, param := range manifest.Functions[0].Parameters {
+		assert.Equal(t, "int64", param.GoType)
+		assert.NotEmpty(t, param.Register)
+		assert.False(t, param.Stack)
+	}
+	assert.Equal(t, "l2", manifest.Functions[1].Name)
+	assert.Equal(t, "unsafe.Pointer", manifest.Functions[1].Parameters[0].GoType)
+}
+
+func TestBuildTags(t *testing.T) {
+	assembly, err := os.ReadFile(assemblyFile)
+	assert.NoError(t, err)
+	constraint, _, _ := strings.Cut(string(assembly), "\n")
+	if constraint == "//go:build !noasm && "+runtime.GOARCH {
+		t.Skip("generated without --build-tags")
+	}
+	assert.Equal(t, "//go:build !noasm && "+runtime.GOARCH+" && !purego", constraint)
+}
+
+func TestChar(t *testing.T) {
+	assert.Equal(t, int32(1-2+255), widen(1, -2, 255))
+	assert.Equal(t, int8(-5), negate_sc(5))
+	assert.Equal(t, uint8(0xff), low_byte(0x1ff))
+	assert.Equal(t, int8('b'), next_char('a'))
+}
+
+func TestRename(t *testing.T) {
+	assert.Equal(t, int64(3), rename(5, 2, 0))
+	stub, err := os.ReadFile("universal.go")
+	assert.NoError(t, err)
+	assert.Contains(t, string(stub), "func rename(type_, g_, arg2 int64) (result int64)")
+}
+
+func TestVoidParameters(t *testing.T) {
+	assert.Equal(t, int32(42), answer())
+}
+
+func TestAppend(t *testing.T) {
+	stub, err := os.ReadFile("universal.go")
+	assert.NoError(t, err)
+	if !strings.Contains(string(stub), "func twice(") {
+		t.Skip("src/appended.cpp is not appended")
+	}
+	assembly, err := os.ReadFile(assemblyFile)
+	assert.NoError(t, err)
+	for _, name := range []string{"add", "twice", "square"} {
+		assert.Contains(t, string(stub), "func "+name+"(")
+		assert.Contains(t, string(assembly), "TEXT ·"+name+"(SB)")
+	}
+	assert.NotContains(t, string(stub), "func cxx_only(")
+	// compiled again at a higher optimization level without the call
+	assert.NotContains(t, string(assembly), "__powidf2")
+}
+
+func TestArrayParameters(t *testing.T) {
+	m := make([]float64, 16)
+	for i := range m {
+		m[i] = float64(i)
+	}
+	rows := [][2]int64{{0, 0}, {100, 0}}
+	assert.Equal(t, float64(0+5+10+15+100), trace4(unsafe.Pointer(&m[0]), nil, unsafe.Pointer(&rows[0])))
+}
+
+func TestSlices(t *testing.T) {
+	assert.Equal(t, float32(6), sum_f_slice([]float32{1, 2, 3}))
+	assert.Equal(t, float32(0), sum_f_slice(nil))
+	a := []float32{3, 4}
+	assert.Equal(t, float32(25), l2_slice(a, make([]float32, 2)))
+	assert.Panics(t, func() { l2_slice(a, nil) })
+}
+
+func TestMix(t *testing.T) {
+	assert.Equal(t, float32(0.5+2-3), mix(0.5, 2, -3))
+}
+
+func TestC11(t *testing.T) {
+	assert.Equal(t, int64(42), generic_twice(21))
+}
+
+func TestEmbedSource(t *testing.T) {
+	stub, err := os.ReadFile("universal.go")
+	assert.NoError(t, err)
+	if !strings.Contains(string(stub), "// sha256: ") {
+		t.Skip("generated without --embed-source")
+	}
+	// the header records every source appended
+	assembly, err := os.ReadFile(assemblyFile)
+	assert.NoError(t, err)
+	var paths []string
+	for _, line := range strings.Split(string(stub), "\n") {
+		if path, ok := strings.CutPrefix(line, "// source: "); ok {
+			paths = append(paths, path)
+		}
+	}
+	assert.Len(t, paths, 2)
+	for _, path := range paths {
+		source, err := os.ReadFile(filepath.Join("src", filepath.Base(path)))
+		assert.NoError(t, err)
+		assert.Contains(t, string(stub), fmt.Sprintf("// source: %v\n// sha256: %x\n", path, sha256.Sum256(source)))
+		assert.Contains(t, string(assembly), fmt.Sprintf("// source: %v\n// sha256: %x\n", path, sha256.Sum256(source)))
+		first, _, _ := strings.Cut(string(source), "\n")
+		assert.Contains(t, string(stub), "// source code of "+path+":\n//\n//\t"+first+"\n")
+	}
+}
+
+func TestNosplit(t *testing.T) {
+	assert.Equal(t, int64(64*3+63*64/2), stack_buffer(3))
+	assembly, err := os.ReadFile(assemblyFile)
+	assert.NoError(t, err)
+	// stack_buffer allocates 512 bytes, which its frame reserves
+	match := regexp.MustCompile(`TEXT ·stack_buffer\(SB\), \$(\d+)-`).FindSubmatch(assembly)
+	if assert.NotNil(t, match) {
+		frame, _ := strconv.Atoi(string(match[1]))
+		assert.GreaterOrEqual(t, frame, 512)
+	}
+	// so that its prologue checks that the stack fits, which needs the symbols that go test strips
+	binary := filepath.Join(t.TempDir(), "tests.test")
+	output, err := exec.Command("go", "test", "-c", "-o", binary, ".").CombinedOutput()
+	assert.NoError(t, err, string(output))
+	output, err = exec.Command("go", "tool", "objdump", "-s", `\.stack_buffer\.abi0$`, binary).CombinedOutput()
+	assert.NoError(t, err, string(output))
+	assert.Contains(t, string(output), "runtime.morestack")
+	if !strings.Contains(string(assembly), "NOSPLIT") {
+		t.Skip("generated with --no-auto-nosplit")
+	}
+	// add is a leaf function without stack
+	assert.Contains(t, string(assembly), "TEXT ·add(SB), NOSPLIT, $")
+}
+
+func TestBuiltin(t *testing.T) {
+	assert.Equal(t, float64(3), root(9))
+}
+
+func TestLengthPragma(t *testing.T) {
+	assert.Equal(t, float64(10), sum4_slice([]float64{1, 2, 3, 4, 5}))
+	assert.Panics(t, func() { sum4_slice([]float64{1, 2, 3}) })
+	stub, err := os.ReadFile("universal.go")
+	assert.NoError(t, err)
+	assert.Contains(t, string(stub), "// v points to 4 elements.\n//go:noescape\nfunc sum4(")
+}
+
+func TestDefine(t *testing.T) {
+	assert.Equal(t, int64(6), scale(2))
+}
+
+func TestPrototypes(t *testing.T) {
+	assert.Equal(t, int64(3), forward(2))
+	stub, err := os.ReadFile("universal.go")
+	assert.NoError(t, err)
+	assert.NotContains(t, string(stub), "func header_only(")
+	assert.NotContains(t, string(stub), "func sqrt(")
+}
+
+func TestPointerResult(t *testing.T) {
+	a := []int64{1, 2, 3}
+	assert.Equal(t, unsafe.Pointer(&a[2]), advance(unsafe.Pointer(&a[0]), 16))
+	stub, err := os.ReadFile("universal.go")
+	assert.NoError(t, err)
+	assert.Contains(t, string(stub), "func advance(p unsafe.Pointer, n int64) (result unsafe.Pointer)\n")
+	assert.NotContains(t, string(stub), "//go:noescape\nfunc advance(")
+}
+
+func TestBool(t *testing.T) {
+	assert.Equal(t, int64(2), count_true_slice([]bool{true, false, true}))
+	assembly, err := os.ReadFile(assemblyFile)
+	assert.NoError(t, err)
+	// the result is stored as a single byte, not over the bytes after it
+	_, text, _ := strings.Cut(string(assembly), "TEXT ·_not(SB)")
+	text, _, _ = strings.Cut(text, "TEXT ·")
+	assert.Regexp(t, `MOVB\s+\w+, result\+\d+\(FP\)`, text)
+}
+
+func TestInt32(t *testing.T) {
+	assert.Equal(t, int32(-3), sub32(2, 5))
+	assert.Equal(t, uint32(0xffffffff), max32(0xffffffff, 1))
+}
+
+func TestAtomic(t *testing.T) {
+	counter := int64(7)
+	assert.Equal(t, int64(7), load_atomic(unsafe.Pointer(&counter)))
+	assert.Equal(t, int64(5), add_atomic(2, 3))
+}
+
+func TestVerboseAsm(t *testing.T) {
+	assembly, err := os.ReadFile(assemblyFile)
+	assert.NoError(t, err)
+	if !strings.Contains(string(assembly), "//   a: ") {
+		t.Skip("generated without --verbose-asm")
+	}
+	assert.Regexp(t, `\n// long add\(long a, long b\)\n//   a: \w+\n//   b: \w+\nTEXT ·add\(SB\)`, string(assembly))
+}
+
+func TestSharedStub(t *testing.T) {
+	stub, err := os.ReadFile("universal.go")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(stub), "//go:build !noasm && (amd64 || arm64 || loong64 || riscv64) && !purego\n"))
+	_, err = os.Stat(assemblyFile)
+	assert.NoError(t, err)
+	_, err = os.Stat("universal.s")
+	assert.True(t, os.IsNotExist(err))
+}